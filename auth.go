@@ -10,6 +10,11 @@ import (
 )
 
 func authMiddleware(next http.Handler) http.Handler {
+	return basicAuthHandler(next, username, password)
+}
+
+// basicAuthHandler only passes requests with the given credentials to next.
+func basicAuthHandler(next http.Handler, username, password string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 		auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
@@ -19,7 +24,7 @@ func authMiddleware(next http.Handler) http.Handler {
 		}
 		payload, _ := base64.StdEncoding.DecodeString(auth[1])
 		pair := strings.SplitN(string(payload), ":", 2)
-		if strings.Compare(pair[0], username) != 0 || strings.Compare(pair[1], password) != 0 {
+		if len(pair) != 2 || strings.Compare(pair[0], username) != 0 || strings.Compare(pair[1], password) != 0 {
 			http.Error(w, "authorization failed", http.StatusUnauthorized)
 			return
 		}
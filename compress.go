@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// minCompressSize is the smallest response body that gets compressed. Below it
+// the encoding overhead outweighs the savings.
+const minCompressSize = 1024
+
+// encoder is implemented by the gzip, brotli and zstd writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var gzPool = sync.Pool{
+	New: func() interface{} {
+		w := gzip.NewWriter(io.Discard)
+		return w
+	},
+}
+
+var brPool = sync.Pool{
+	New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression)
+	},
+}
+
+var zstdPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+		return w
+	},
+}
+
+// encoderPools lists the supported encodings in order of preference when the
+// client accepts several with the same weight.
+var encoderPools = []struct {
+	name string
+	pool *sync.Pool
+}{
+	{"br", &brPool},
+	{"zstd", &zstdPool},
+	{"gzip", &gzPool},
+}
+
+// negotiateEncoding picks the encoding to use from an Accept-Encoding header,
+// or returns an empty string if none of the supported encodings is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	if accepted := acceptedEncodings(acceptEncoding); len(accepted) > 0 {
+		return accepted[0]
+	}
+	return ""
+}
+
+// acceptedEncodings returns the supported encodings the client accepts, best
+// first. Encodings with the same weight keep the order of encoderPools.
+func acceptedEncodings(acceptEncoding string) []string {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				weight = parsed
+			}
+		}
+		weights[name] = weight
+	}
+
+	var accepted []string
+	for _, enc := range encoderPools {
+		weight, ok := weights[enc.name]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > 0 {
+			accepted = append(accepted, enc.name)
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return encodingWeight(weights, accepted[i]) > encodingWeight(weights, accepted[j])
+	})
+	return accepted
+}
+
+func encodingWeight(weights map[string]float64, name string) float64 {
+	if weight, ok := weights[name]; ok {
+		return weight
+	}
+	return weights["*"]
+}
+
+// isCompressible reports whether a Content-Type benefits from compression.
+// Images other than SVG, audio, video and archives are already compressed.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/x-javascript", "application/json", "application/xml",
+		"application/wasm", "application/manifest+json", "font/ttf", "font/otf", "image/x-icon":
+		return true
+	}
+	return false
+}
+
+// compressHandler compresses responses with the best encoding the client
+// accepts. Range requests, responses that already have a Content-Encoding,
+// incompressible types and bodies smaller than minCompressSize are passed
+// through unchanged.
+func compressHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+			path:           r.URL.Path,
+		}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter decides whether to compress when the status is
+// written, because only then are the Content-Type and Content-Length known.
+// For a 304 the Content-Type is already removed, so the request path decides.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	path        string
+	encoder     encoder
+	pool        *sync.Pool
+	wroteHeader bool
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	if status == http.StatusNotModified && isCompressiblePath(w.path) {
+		// Match the headers of the 200 this revalidates, so caches refresh it
+		addVaryAcceptEncoding(header)
+		if w.encoding != "" {
+			weakenETag(header)
+		}
+	}
+	if status == http.StatusOK && header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) {
+		addVaryAcceptEncoding(header)
+		if w.encoding != "" && !isSmallBody(header.Get("Content-Length")) {
+			for _, enc := range encoderPools {
+				if enc.name == w.encoding {
+					w.pool = enc.pool
+				}
+			}
+			w.encoder = w.pool.Get().(encoder)
+			w.encoder.Reset(w.ResponseWriter)
+			header.Set("Content-Encoding", w.encoding)
+			header.Del("Content-Length")
+			// The compressed bytes differ from the ones the strong ETag describes
+			weakenETag(header)
+			log.Debug().Str("encoding", w.encoding).Msg("Compressing response")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// isCompressiblePath reports whether the file a request path serves has a
+// compressible type, judged by its extension. Directory paths serve
+// index.html.
+func isCompressiblePath(urlPath string) bool {
+	if strings.HasSuffix(urlPath, "/") {
+		urlPath += "index.html"
+	}
+	return isCompressible(mime.TypeByExtension(path.Ext(urlPath)))
+}
+
+// addVaryAcceptEncoding adds Accept-Encoding to the Vary header unless it is
+// already listed.
+func addVaryAcceptEncoding(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// weakenETag turns a strong ETag into a weak one.
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+func isSmallBody(contentLength string) bool {
+	size, err := strconv.ParseInt(contentLength, 10, 64)
+	return err == nil && size < minCompressSize
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile working for responses that are not compressed.
+func (w *compressResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return io.Copy(w.encoder, r)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *compressResponseWriter) Flush() {
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close flushes the encoder and returns it to its pool.
+func (w *compressResponseWriter) Close() error {
+	if w.encoder == nil {
+		return nil
+	}
+	err := w.encoder.Close()
+	w.encoder.Reset(io.Discard)
+	w.pool.Put(w.encoder)
+	w.encoder = nil
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.1, gzip;q=0.5", "gzip"},
+		{"GZIP", "gzip"},
+	}
+	for _, test := range tests {
+		if got := negotiateEncoding(test.header); got != test.expected {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", test.header, got, test.expected)
+		}
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	tests := map[string]bool{
+		"text/html; charset=utf-8": true,
+		"text/css":                 true,
+		"application/javascript":   true,
+		"application/json":         true,
+		"application/ld+json":      true,
+		"image/svg+xml":            true,
+		"image/png":                false,
+		"video/mp4":                false,
+		"application/zip":          false,
+		"font/woff2":               false,
+		"":                         false,
+	}
+	for contentType, expected := range tests {
+		if got := isCompressible(contentType); got != expected {
+			t.Errorf("isCompressible(%q) = %v, want %v", contentType, got, expected)
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	dir := t.TempDir()
+	large := strings.Repeat("<p>compress me</p>\n", 200)
+	files := map[string]string{
+		"large.html": large,
+		"small.html": "<p>small</p>",
+		"image.png":  strings.Repeat("x", 4096),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	envFS := EnvFileSystem{fs: http.Dir(dir)}
+	handler := compressHandler(fileServer(envFS, setETag))
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		rec := get("/large.html", map[string]string{"Accept-Encoding": encoding})
+		if got := rec.Header().Get("Content-Encoding"); got != encoding {
+			t.Errorf("Expected Content-Encoding %s, got %q", encoding, got)
+			continue
+		}
+		if rec.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: expected Content-Length to be removed", encoding)
+		}
+		if !strings.HasPrefix(rec.Header().Get("ETag"), `W/"`) {
+			t.Errorf("%s: expected weak ETag, got %q", encoding, rec.Header().Get("ETag"))
+		}
+		reader, err := decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: failed to create decoder: %v", encoding, err)
+		}
+		if body, err := io.ReadAll(reader); err != nil || string(body) != large {
+			t.Errorf("%s: decoded body does not match (err=%v)", encoding, err)
+		}
+	}
+
+	rec := get("/large.html", nil)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != large {
+		t.Error("Expected uncompressed response without Accept-Encoding")
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding, got %q", rec.Header().Get("Vary"))
+	}
+
+	if rec := get("/small.html", map[string]string{"Accept-Encoding": "gzip"}); rec.Header().Get("Content-Encoding") != "" {
+		t.Error("Expected small bodies not to be compressed")
+	}
+	if rec := get("/image.png", map[string]string{"Accept-Encoding": "gzip"}); rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "" {
+		t.Error("Expected images not to be compressed")
+	}
+
+	rec = get("/large.html", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9"})
+	if rec.Code != http.StatusPartialContent || rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != large[:10] {
+		t.Errorf("Expected uncompressed partial content for range requests, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := get("/missing.html", map[string]string{"Accept-Encoding": "gzip"}); rec.Code != http.StatusNotFound || rec.Header().Get("Content-Encoding") != "" {
+		t.Error("Expected error responses not to be compressed")
+	}
+}
+
+func TestCompressHandlerNotModified(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"large.html": strings.Repeat("<p>compress me</p>\n", 200),
+		"image.png":  strings.Repeat("x", 4096),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	handler := compressHandler(fileServer(EnvFileSystem{fs: http.Dir(dir)}, setETag))
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	full := get("/large.html", map[string]string{"Accept-Encoding": "gzip"})
+	etag := full.Header().Get("ETag")
+	rec := get("/large.html", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("Expected the 304 ETag %q to match the compressed 200, got %q", etag, got)
+	}
+	if got := rec.Header().Values("Vary"); len(got) != 1 || got[0] != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding on 304, got %q", got)
+	}
+
+	plain := get("/large.html", nil)
+	rec = get("/large.html", map[string]string{"If-None-Match": plain.Header().Get("ETag")})
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != plain.Header().Get("ETag") || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected uncompressed 304 with strong ETag and Vary, got %d %q %q", rec.Code, rec.Header().Get("ETag"), rec.Header().Get("Vary"))
+	}
+
+	image := get("/image.png", map[string]string{"Accept-Encoding": "gzip"})
+	rec = get("/image.png", map[string]string{"Accept-Encoding": "gzip", "If-Modified-Since": image.Header().Get("Last-Modified")})
+	if rec.Code != http.StatusNotModified || rec.Header().Get("Vary") != "" {
+		t.Errorf("Expected image 304 without Vary, got %d %q", rec.Code, rec.Header().Get("Vary"))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// decodeConfigFile strictly decodes a JSON, YAML or TOML file into out, picking
+// the format by extension and defaulting to JSON. Unknown fields are errors,
+// and errors include the line and column where the decoder reports them.
+func decodeConfigFile(path string, out interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = decodeYAMLConfig(data, out)
+	case ".toml":
+		err = decodeTOMLConfig(data, out)
+	default:
+		err = decodeJSONConfig(data, out)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func decodeJSONConfig(data []byte, out interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return positionError(data, syntaxErr.Offset, err)
+		case errors.As(err, &typeErr):
+			return positionError(data, typeErr.Offset, err)
+		case errors.Is(err, io.EOF):
+			return errors.New("file is empty")
+		}
+		return positionError(data, decoder.InputOffset(), err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return positionError(data, decoder.InputOffset(), errors.New("unexpected data after the end of the config"))
+	}
+	return nil
+}
+
+func decodeYAMLConfig(data []byte, out interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(out); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("file is empty")
+		}
+		return err
+	}
+	return nil
+}
+
+func decodeTOMLConfig(data []byte, out interface{}) error {
+	meta, err := toml.Decode(string(data), out)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return fmt.Errorf("line %d, column %d: %s", parseErr.Position.Line, parseErr.Position.Col, parseErr.Message)
+		}
+		return err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("unknown fields: %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// positionError prefixes err with the 1-based line and column of the byte
+// before offset, which is where encoding/json reports the error.
+func positionError(data []byte, offset int64, err error) error {
+	index := int(min(max(offset-1, 0), int64(len(data))))
+	before := data[:index]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := index - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func TestLoadHeaderConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"headers.json": `{"configs": [{"path": "/static/", "fileExtensions": ["js"], "status": [200, "3xx"], "headers": [{"key": "Cache-Control", "value": "immutable"}]}]}`,
+		"headers.yaml": `
+configs:
+  - path: /static/
+    fileExtensions: [js]
+    status: [200, 3xx]
+    headers:
+      - key: Cache-Control
+        value: immutable
+`,
+		"headers.toml": `
+[[configs]]
+path = "/static/"
+fileExtensions = ["js"]
+status = [200, "3xx"]
+
+[[configs.headers]]
+key = "Cache-Control"
+value = "immutable"
+`,
+	}
+	for name, content := range files {
+		configs, err := loadHeaderConfig(writeConfigFile(t, name, content))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if len(configs.Configs) != 1 {
+			t.Errorf("%s: expected 1 rule, got %+v", name, configs)
+			continue
+		}
+		config := configs.Configs[0]
+		if config.Path != "/static/" || len(config.FileExtensions) != 1 || config.FileExtensions[0] != "js" {
+			t.Errorf("%s: unexpected rule %+v", name, config)
+		}
+		if len(config.Status) != 2 || config.Status[0] != "200" || config.Status[1] != "3xx" {
+			t.Errorf("%s: unexpected status %v", name, config.Status)
+		}
+		if len(config.Headers) != 1 || config.Headers[0].Key != "Cache-Control" || config.Headers[0].Value != "immutable" {
+			t.Errorf("%s: unexpected headers %+v", name, config.Headers)
+		}
+	}
+}
+
+func TestLoadHeaderConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"syntax.json", "{\n  \"configs\": [\n    {\"path\": \"/\",}\n  ]\n}", "line 3, column 18"},
+		{"type.json", "{\n  \"configs\": [{\"path\": 1}]\n}", "line 2, column 24"},
+		{"unknown.json", `{"configs": [{"pth": "/"}]}`, `unknown field "pth"`},
+		{"trailing.json", `{"configs": []} {}`, "unexpected data"},
+		{"empty.json", "", "empty"},
+		{"empty.yaml", "", "empty"},
+		{"comments.yml", "# nothing here\n", "empty"},
+		{"unknown.yaml", "configs:\n  - pth: /\n", "line 2: field pth not found"},
+		{"syntax.yml", "configs:\n  - path: [\n", "line"},
+		{"unknown.toml", "[[configs]]\npth = \"/\"\n", "unknown fields: configs.pth"},
+		{"syntax.toml", "[[configs]]\npath = \n", "line 2, column"},
+		{"rule.json", `{"configs": [{"path": "/"}, {"path": "~("}]}`, "rule 1: invalid regexp"},
+	}
+	for _, test := range tests {
+		path := writeConfigFile(t, test.name, test.content)
+		_, err := loadHeaderConfig(path)
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) || !strings.HasPrefix(err.Error(), path) {
+			t.Errorf("%s: expected error with path and %q, got %v", test.name, test.want, err)
+		}
+	}
+}
+
+func TestInitHeaderConfigMissingFile(t *testing.T) {
+	valid, err := initHeaderConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if valid || err != nil {
+		t.Errorf("Expected missing config to disable the middleware without error, got %v, %v", valid, err)
+	}
+}
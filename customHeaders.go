@@ -2,29 +2,119 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"fmt"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
 )
 
 type HeaderConfigArray struct {
-	Configs []HeaderConfig `json:"configs"`
+	Configs []HeaderConfig `json:"configs" yaml:"configs" toml:"configs"`
 }
 
+// HeaderConfig is one header rule. Path and Paths hold path patterns and
+// FileExtension and FileExtensions hold extensions; the single and list forms
+// are combined. Status, Methods and RequestHeaders further restrict the rule
+// to certain responses and requests. Omitting a condition matches every
+// request. Rules are applied in ascending Priority, and in file order within
+// the same priority.
 type HeaderConfig struct {
-	Path          string            `json:"path"`
-	FileExtension string            `json:"fileExtension"`
-	Headers       []HeaderDefiniton `json:"headers"`
+	Path           string            `json:"path" yaml:"path" toml:"path"`
+	Paths          []string          `json:"paths" yaml:"paths" toml:"paths"`
+	FileExtension  string            `json:"fileExtension" yaml:"fileExtension" toml:"fileExtension"`
+	FileExtensions []string          `json:"fileExtensions" yaml:"fileExtensions" toml:"fileExtensions"`
+	Status         StatusList        `json:"status" yaml:"status" toml:"status"`
+	Methods        []string          `json:"methods" yaml:"methods" toml:"methods"`
+	RequestHeaders map[string]string `json:"requestHeaders" yaml:"requestHeaders" toml:"requestHeaders"`
+	Priority       int               `json:"priority,omitempty" yaml:"priority" toml:"priority"`
+	Headers        []HeaderDefiniton `json:"headers" yaml:"headers" toml:"headers"`
+}
+
+// StatusList holds status codes such as 404 or classes such as "4xx". Config
+// files may give them as numbers or strings.
+type StatusList []string
+
+func (l *StatusList) UnmarshalJSON(data []byte) error {
+	var values []interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	return l.set(values)
+}
+
+func (l *StatusList) UnmarshalYAML(node *yaml.Node) error {
+	var values []interface{}
+	if err := node.Decode(&values); err != nil {
+		return err
+	}
+	return l.set(values)
+}
+
+func (l *StatusList) UnmarshalTOML(data interface{}) error {
+	values, ok := data.([]interface{})
+	if !ok {
+		return fmt.Errorf("status must be a list, got %v", data)
+	}
+	return l.set(values)
+}
+
+func (l *StatusList) set(values []interface{}) error {
+	*l = make(StatusList, 0, len(values))
+	for _, value := range values {
+		switch v := value.(type) {
+		case float64:
+			*l = append(*l, strconv.Itoa(int(v)))
+		case int:
+			*l = append(*l, strconv.Itoa(v))
+		case int64:
+			*l = append(*l, strconv.FormatInt(v, 10))
+		case string:
+			*l = append(*l, v)
+		default:
+			return fmt.Errorf("invalid status %v", value)
+		}
+	}
+	return nil
 }
 
+// HeaderDefiniton is one header operation of a rule. Operation is one of
+// set (the default), add, setIfMissing or delete; delete ignores Value.
 type HeaderDefiniton struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key       string `json:"key" yaml:"key" toml:"key"`
+	Value     string `json:"value" yaml:"value" toml:"value"`
+	Operation string `json:"operation,omitempty" yaml:"operation" toml:"operation"`
 }
 
-var headerConfigs HeaderConfigArray
+// apply performs the operation on a response header.
+func (d HeaderDefiniton) apply(header http.Header, key, value string) {
+	switch strings.ToLower(d.Operation) {
+	case "add":
+		header.Add(key, value)
+	case "setifmissing":
+		if len(header.Values(key)) == 0 {
+			header.Set(key, value)
+		}
+	case "delete":
+		removeHeader(header, key)
+	default:
+		header.Set(key, value)
+	}
+}
+
+// headerConfigs holds the active header rules. It is swapped as a whole when
+// the config file is reloaded, so requests always see a complete rule set.
+var headerConfigs atomic.Pointer[HeaderConfigArray]
 
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -34,36 +124,332 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func initHeaderConfig(headerConfigPath string) bool {
-	headerConfigValid := false
+// initHeaderConfig loads the header rules into headerConfigs. A missing file
+// is not an error and leaves the middleware disabled; a malformed one is.
+func initHeaderConfig(headerConfigPath string) (bool, error) {
+	if !fileExists(headerConfigPath) {
+		return false, nil
+	}
+	configs, err := loadHeaderConfig(headerConfigPath)
+	if err != nil {
+		return false, err
+	}
+	headerConfigs.Store(&configs)
+	return len(configs.Configs) > 0, nil
+}
+
+// loadHeaderConfig strictly decodes and validates a JSON, YAML or TOML header
+// config file.
+func loadHeaderConfig(headerConfigPath string) (HeaderConfigArray, error) {
+	var configs HeaderConfigArray
+	if err := decodeConfigFile(headerConfigPath, &configs); err != nil {
+		return HeaderConfigArray{}, err
+	}
+	for i, config := range configs.Configs {
+		if err := config.validate(); err != nil {
+			return HeaderConfigArray{}, fmt.Errorf("%s: rule %d: %w", headerConfigPath, i, err)
+		}
+	}
+	sort.SliceStable(configs.Configs, func(i, j int) bool {
+		return configs.Configs[i].Priority < configs.Configs[j].Priority
+	})
+	return configs, nil
+}
+
+// watchHeaderConfig reloads the header rules whenever the config file changes.
+// If the new file is invalid the previous rules stay active. A removed file
+// removes all rules.
+func watchHeaderConfig(headerConfigPath string, interval time.Duration) (stop func()) {
+	log.Debug().Str("path", headerConfigPath).Dur("interval", interval).Msg("Watching header config")
+	return watchPaths([]string{headerConfigPath}, interval, func() {
+		reloadHeaderConfig(headerConfigPath)
+	})
+}
+
+func reloadHeaderConfig(headerConfigPath string) {
+	var configs HeaderConfigArray
 	if fileExists(headerConfigPath) {
-		jsonFile, err := os.Open(headerConfigPath)
-		if err == nil {
-			byteValue, _ := io.ReadAll(jsonFile)
-			json.Unmarshal(byteValue, &headerConfigs)
-			if len(headerConfigs.Configs) > 0 {
-				headerConfigValid = true
+		loaded, err := loadHeaderConfig(headerConfigPath)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to reload header config, keeping previous rules")
+			return
+		}
+		configs = loaded
+	}
+
+	previous := headerConfigs.Swap(&configs)
+	added, removed := diffHeaderConfigs(previous, &configs)
+	log.Info().Str("path", headerConfigPath).Int("rules", len(configs.Configs)).Strs("added", added).Strs("removed", removed).Msg("Reloaded header config")
+	if err := checkEnvVarsInHeaderConfig(configs); err != nil {
+		log.Warn().Err(err).Msg("Reloaded header config references missing variables")
+	}
+}
+
+// diffHeaderConfigs lists the rules, as JSON, that only exist in next and
+// those that only existed in previous.
+func diffHeaderConfigs(previous, next *HeaderConfigArray) (added, removed []string) {
+	counts := make(map[string]int)
+	if previous != nil {
+		for _, config := range previous.Configs {
+			counts[headerConfigString(config)]++
+		}
+	}
+	for _, config := range next.Configs {
+		key := headerConfigString(config)
+		if counts[key] > 0 {
+			counts[key]--
+			continue
+		}
+		added = append(added, key)
+	}
+	if previous != nil {
+		for _, config := range previous.Configs {
+			key := headerConfigString(config)
+			if counts[key] > 0 {
+				counts[key]--
+				removed = append(removed, key)
 			}
-			jsonFile.Close()
 		}
 	}
-	return headerConfigValid
+	return added, removed
 }
 
+func headerConfigString(config HeaderConfig) string {
+	data, _ := json.Marshal(config)
+	return string(data)
+}
+
+// customHeadersMiddleware applies the header rules right before the status is
+// written, so rules can depend on the response status.
 func customHeadersMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		reqFileExtension := filepath.Ext(r.URL.Path)
-		for i := 0; i < len(headerConfigs.Configs); i++ {
-			configEntry := headerConfigs.Configs[i]
-			fileMatch := configEntry.FileExtension == "*" || reqFileExtension == "."+configEntry.FileExtension
-			pathMatch := configEntry.Path == "*" || strings.HasPrefix(r.URL.Path, configEntry.Path)
-			if fileMatch && pathMatch {
-				for j := 0; j < len(configEntry.Headers); j++ {
-					headerEntry := configEntry.Headers[j]
-					w.Header().Set(headerEntry.Key, headerEntry.Value)
-				}
+	return beforeWriteHeader(next, func(w http.ResponseWriter, r *http.Request, status int) {
+		configs := headerConfigs.Load()
+		if configs == nil {
+			return
+		}
+		for i := 0; i < len(configs.Configs); i++ {
+			configEntry := configs.Configs[i]
+			if configEntry.matches(r, status) {
+				applyHeaderDefinitions(w.Header(), configEntry.Headers)
 			}
 		}
-		next.ServeHTTP(w, r)
 	})
 }
+
+// applyHeaderDefinitions performs the header operations in order, with
+// environment variables substituted in keys and values.
+func applyHeaderDefinitions(header http.Header, headers []HeaderDefiniton) {
+	for _, headerEntry := range headers {
+		key := replaceEnvVars(headerEntry.Key)
+		if strings.Contains(key, "${") {
+			log.Debug().Str("key", key).Msg("Skipping header with unresolved name")
+			continue
+		}
+		headerEntry.apply(header, key, replaceEnvVars(headerEntry.Value))
+	}
+}
+
+func (c HeaderConfig) pathPatterns() []string {
+	if c.Path == "" {
+		return c.Paths
+	}
+	return append([]string{c.Path}, c.Paths...)
+}
+
+func (c HeaderConfig) extensions() []string {
+	if c.FileExtension == "" {
+		return c.FileExtensions
+	}
+	return append([]string{c.FileExtension}, c.FileExtensions...)
+}
+
+// matches reports whether the rule applies to a request and response status.
+func (c HeaderConfig) matches(r *http.Request, status int) bool {
+	if !c.matchesPath(r.URL.Path) {
+		return false
+	}
+	if !matchPatternList(c.Status, func(pattern string) bool { return matchStatus(pattern, status) }) {
+		return false
+	}
+	if !matchPatternList(c.Methods, func(method string) bool { return strings.EqualFold(method, r.Method) }) {
+		return false
+	}
+	for name, pattern := range c.RequestHeaders {
+		if !matchPatternList([]string{pattern}, func(pattern string) bool { return matchHeaderValue(r.Header.Values(name), pattern) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesPath reports whether the rule applies to a request path.
+func (c HeaderConfig) matchesPath(urlPath string) bool {
+	return matchPatternList(c.pathPatterns(), func(pattern string) bool {
+		return matchHeaderPath(urlPath, pattern)
+	}) && matchPatternList(c.extensions(), func(ext string) bool {
+		return ext == "*" || filepath.Ext(urlPath) == "."+strings.TrimPrefix(ext, ".")
+	})
+}
+
+// matchPatternList matches a list of patterns in which entries starting with !
+// exclude what they match. The list matches if no negated entry matches and
+// any other entry does, or if there are only negated entries.
+func matchPatternList(patterns []string, match func(pattern string) bool) bool {
+	positive, matched := false, false
+	for _, pattern := range patterns {
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			if match(negated) {
+				return false
+			}
+			continue
+		}
+		positive = true
+		matched = matched || match(pattern)
+	}
+	return matched || !positive
+}
+
+// matchHeaderPath matches a request path against a header rule pattern:
+//
+//	/static/           paths starting with /static/, or every path for *
+//	/assets/**/*.woff2 glob against the whole path, ** spans directories
+//	*.map              glob against the file name if there is no slash
+//	~^/v[0-9]+/        regular expression
+//
+// Unlike the --env-include rules, plain paths are prefixes of the URL path,
+// which keeps header configs of earlier versions working.
+func matchHeaderPath(urlPath, pattern string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "~"):
+		re, err := headerRuleRegexp(pattern[1:])
+		return err == nil && re.MatchString(urlPath)
+	case strings.ContainsAny(pattern, "*?["):
+		if strings.Contains(pattern, "/") {
+			return globMatch("/"+strings.TrimPrefix(pattern, "/"), urlPath)
+		}
+		return globMatch(pattern, path.Base(urlPath))
+	}
+	return strings.HasPrefix(urlPath, pattern)
+}
+
+// matchStatus matches a status code against a code such as 404 or a class
+// such as 4xx.
+func matchStatus(pattern string, status int) bool {
+	code := strconv.Itoa(status)
+	if len(pattern) != len(code) {
+		return false
+	}
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != code[i] && pattern[i] != 'x' && pattern[i] != 'X' {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHeaderValue matches the values of a request header against a pattern:
+// * if the header is present, ~ followed by a regular expression, or a glob.
+func matchHeaderValue(values []string, pattern string) bool {
+	if pattern == "*" {
+		return len(values) > 0
+	}
+	for _, value := range values {
+		if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+			if re, err := headerRuleRegexp(expr); err == nil && re.MatchString(value) {
+				return true
+			}
+		} else if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+var headerRuleRegexps sync.Map
+
+// headerRuleRegexp compiles regular expressions from header rules once.
+func headerRuleRegexp(expr string) (*regexp.Regexp, error) {
+	if re, ok := headerRuleRegexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	headerRuleRegexps.Store(expr, re)
+	return re, nil
+}
+
+func (c HeaderConfig) validate() error {
+	patterns := c.pathPatterns()
+	for _, pattern := range c.RequestHeaders {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "!")
+		if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+			if _, err := headerRuleRegexp(expr); err != nil {
+				return fmt.Errorf("invalid regexp %q: %w", expr, err)
+			}
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if err := validateHeaderDefinitions(c.Headers); err != nil {
+		return err
+	}
+	for _, status := range c.Status {
+		code := strings.TrimPrefix(status, "!")
+		if len(code) != 3 || strings.Trim(strings.ToLower(code), "0123456789x") != "" {
+			return fmt.Errorf("invalid status %q", status)
+		}
+	}
+	return nil
+}
+
+func validateHeaderDefinitions(headers []HeaderDefiniton) error {
+	for i, header := range headers {
+		if strings.TrimSpace(header.Key) == "" {
+			return fmt.Errorf("header %d has no key", i)
+		}
+		switch strings.ToLower(header.Operation) {
+		case "", "set", "add", "setifmissing", "delete":
+		default:
+			return fmt.Errorf("header %d has unknown operation %q", i, header.Operation)
+		}
+	}
+	return nil
+}
+
+// checkEnvVarsInHeaderConfig reports variables referenced from header keys and
+// values that can't be resolved.
+func checkEnvVarsInHeaderConfig(configs HeaderConfigArray) error {
+	return checkEnvVarsInHeaders("header config", configs.definitions())
+}
+
+// checkEnvVarsInHeaders reports the variables of headers that can't be
+// resolved, naming source, the config the headers come from, in the error.
+func checkEnvVarsInHeaders(source string, headers []HeaderDefiniton) error {
+	missing := make(map[string]string)
+	x := expander{onUnresolved: func(p *placeholder, reason string) {
+		if missing[p.name] == "" {
+			missing[p.name] = reason
+		}
+	}}
+	for _, header := range headers {
+		x.render(parseTemplate(header.Key), false)
+		x.render(parseTemplate(header.Value), false)
+	}
+	return missingVarsError("missing environment variables in "+source, sortedMissing(missing))
+}
+
+// definitions lists the headers of all rules.
+func (c HeaderConfigArray) definitions() []HeaderDefiniton {
+	var headers []HeaderDefiniton
+	for _, config := range c.Configs {
+		headers = append(headers, config.Headers...)
+	}
+	return headers
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCustomHeadersSubstituteEnvVars(t *testing.T) {
+	os.Setenv("HDR_API_ORIGIN", "https://api.example.com")
+	os.Setenv("HDR_NAME", "X-Api-Origin")
+	defer os.Unsetenv("HDR_API_ORIGIN")
+	defer os.Unsetenv("HDR_NAME")
+
+	previous := headerConfigs.Load()
+	defer headerConfigs.Store(previous)
+	headerConfigs.Store(&HeaderConfigArray{Configs: []HeaderConfig{{
+		Path:          "*",
+		FileExtension: "*",
+		Headers: []HeaderDefiniton{
+			{Key: "Content-Security-Policy", Value: "default-src 'self'; connect-src ${HDR_API_ORIGIN}"},
+			{Key: "${HDR_NAME}", Value: "${HDR_API_ORIGIN}"},
+			{Key: "X-Env", Value: "${HDR_ENV:=production}"},
+			{Key: "${HDR_MISSING_NAME}", Value: "ignored"},
+		},
+	}}})
+
+	handler := customHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/index.html", nil))
+
+	if got := rec.Header().Get("Content-Security-Policy"); got != "default-src 'self'; connect-src https://api.example.com" {
+		t.Errorf("Unexpected Content-Security-Policy %q", got)
+	}
+	if got := rec.Header().Get("X-Api-Origin"); got != "https://api.example.com" {
+		t.Errorf("Expected substituted header name, got %q", got)
+	}
+	if got := rec.Header().Get("X-Env"); got != "production" {
+		t.Errorf("Expected default value, got %q", got)
+	}
+	if len(rec.Header()) != 3 {
+		t.Errorf("Expected header with unresolved name to be skipped, got %v", rec.Header())
+	}
+}
+
+func TestCheckEnvVarsInHeaderConfig(t *testing.T) {
+	os.Setenv("HDRCHK_SET", "set")
+	defer os.Unsetenv("HDRCHK_SET")
+
+	configs := HeaderConfigArray{Configs: []HeaderConfig{{
+		Path:          "*",
+		FileExtension: "html",
+		Headers: []HeaderDefiniton{
+			{Key: "X-Set", Value: "${HDRCHK_SET}"},
+			{Key: "X-Default", Value: "${HDRCHK_DEFAULT:=value}"},
+			{Key: "${HDRCHK_KEY}", Value: "${HDRCHK_VALUE:?needed for CSP}"},
+		},
+	}}}
+
+	err := checkEnvVarsInHeaderConfig(configs)
+	want := "missing environment variables in header config: HDRCHK_KEY, HDRCHK_VALUE (needed for CSP)"
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+	if err != nil && strings.Contains(err.Error(), "HDRCHK_DEFAULT") {
+		t.Error("Did not expect variables with defaults to be reported")
+	}
+
+	configs.Configs[0].Headers = configs.Configs[0].Headers[:2]
+	if err := checkEnvVarsInHeaderConfig(configs); err != nil {
+		t.Errorf("Expected no error when all variables resolve, got %v", err)
+	}
+}
+
+func TestHeaderConfigMatches(t *testing.T) {
+	tests := []struct {
+		config HeaderConfig
+		path   string
+		want   bool
+		desc   string
+	}{
+		{HeaderConfig{Path: "*", FileExtension: "*"}, "/any/file.txt", true, "wildcards match everything"},
+		{HeaderConfig{}, "/any/file.txt", true, "omitted patterns match everything"},
+		{HeaderConfig{Path: "/static/", FileExtension: "*"}, "/static/app.js", true, "prefix match"},
+		{HeaderConfig{Path: "/static/", FileExtension: "*"}, "/other/app.js", false, "prefix mismatch"},
+		{HeaderConfig{Path: "*", FileExtension: "css"}, "/a/b.css", true, "single extension"},
+		{HeaderConfig{Path: "*", FileExtension: ".css"}, "/a/b.css", true, "extension with dot"},
+		{HeaderConfig{Path: "/assets/**/*.woff2"}, "/assets/fonts/latin/a.woff2", true, "double star glob"},
+		{HeaderConfig{Path: "/assets/**/*.woff2"}, "/assets/a.woff2", true, "double star matches no directories"},
+		{HeaderConfig{Path: "/assets/**/*.woff2"}, "/other/a.woff2", false, "double star glob mismatch"},
+		{HeaderConfig{Path: "assets/*.js"}, "/assets/app.js", true, "glob without leading slash"},
+		{HeaderConfig{Path: "*.map"}, "/js/deep/app.js.map", true, "glob without slash matches file name"},
+		{HeaderConfig{Path: "~^/v[0-9]+/"}, "/v2/index.html", true, "regular expression"},
+		{HeaderConfig{Path: "~^/v[0-9]+/"}, "/latest/index.html", false, "regular expression mismatch"},
+		{HeaderConfig{FileExtensions: []string{"js", "mjs"}}, "/app.mjs", true, "extension list"},
+		{HeaderConfig{FileExtensions: []string{"js", "mjs"}}, "/app.css", false, "extension list mismatch"},
+		{HeaderConfig{FileExtension: "!html"}, "/app.js", true, "negated extension"},
+		{HeaderConfig{FileExtension: "!html"}, "/index.html", false, "negated extension excludes"},
+		{HeaderConfig{Paths: []string{"/static/", "!/static/private/**"}}, "/static/app.js", true, "path list with negation"},
+		{HeaderConfig{Paths: []string{"/static/", "!/static/private/**"}}, "/static/private/key.txt", false, "negated path excludes"},
+		{HeaderConfig{Path: "/static/", Paths: []string{"/assets/"}}, "/assets/app.js", true, "single and list forms combine"},
+	}
+	for _, test := range tests {
+		if got := test.config.matchesPath(test.path); got != test.want {
+			t.Errorf("%s: matchesPath(%q) = %v, want %v", test.desc, test.path, got, test.want)
+		}
+	}
+}
+
+func TestHeaderConfigValidate(t *testing.T) {
+	invalid := []HeaderConfig{
+		{Path: "~[invalid"},
+		{Paths: []string{"!/assets/[a-"}},
+		{RequestHeaders: map[string]string{"Origin": "~("}},
+		{Headers: []HeaderDefiniton{{Key: " ", Value: "x"}}},
+	}
+	for _, config := range invalid {
+		if err := config.validate(); err == nil {
+			t.Errorf("Expected validation error for %+v", config)
+		}
+	}
+	valid := HeaderConfig{Path: "~^/v[0-9]+/", Paths: []string{"/ok/", "!/ok/private/**"}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("Expected valid rule, got %v", err)
+	}
+}
+
+func TestHeaderConfigConditions(t *testing.T) {
+	previous := headerConfigs.Load()
+	defer headerConfigs.Store(previous)
+	headerConfigs.Store(&HeaderConfigArray{Configs: []HeaderConfig{
+		{Status: StatusList{"404"}, Headers: []HeaderDefiniton{{Key: "Cache-Control", Value: "no-store"}}},
+		{Status: StatusList{"5xx"}, Headers: []HeaderDefiniton{{Key: "Retry-After", Value: "30"}}},
+		{Methods: []string{"options"}, Headers: []HeaderDefiniton{{Key: "Allow", Value: "GET, HEAD"}}},
+		{
+			RequestHeaders: map[string]string{"Origin": "https://*.example.com"},
+			Headers:        []HeaderDefiniton{{Key: "Access-Control-Allow-Origin", Value: "*"}},
+		},
+		{
+			RequestHeaders: map[string]string{"Authorization": "!*"},
+			Status:         StatusList{"!404"},
+			Headers:        []HeaderDefiniton{{Key: "X-Public", Value: "true"}},
+		},
+	}})
+
+	serve := func(method, target string, status int, requestHeaders map[string]string) http.Header {
+		handler := customHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		req := httptest.NewRequest(method, target, nil)
+		for name, value := range requestHeaders {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Header()
+	}
+
+	header := serve(http.MethodGet, "/missing", http.StatusNotFound, nil)
+	if header.Get("Cache-Control") != "no-store" || header.Get("X-Public") != "" {
+		t.Errorf("Unexpected headers for 404: %v", header)
+	}
+	header = serve(http.MethodGet, "/", http.StatusOK, nil)
+	if header.Get("Cache-Control") != "" || header.Get("X-Public") != "true" {
+		t.Errorf("Unexpected headers for 200: %v", header)
+	}
+	if header := serve(http.MethodGet, "/", http.StatusBadGateway, nil); header.Get("Retry-After") != "30" {
+		t.Errorf("Expected status class to match 502, got %v", header)
+	}
+	if header := serve(http.MethodOptions, "/", http.StatusOK, nil); header.Get("Allow") != "GET, HEAD" {
+		t.Errorf("Expected method to match case-insensitively, got %v", header)
+	}
+	if header := serve(http.MethodGet, "/", http.StatusOK, nil); header.Get("Allow") != "" {
+		t.Errorf("Did not expect method rule on GET, got %v", header)
+	}
+
+	header = serve(http.MethodGet, "/", http.StatusOK, map[string]string{"Origin": "https://app.example.com"})
+	if header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected Origin rule to match, got %v", header)
+	}
+	header = serve(http.MethodGet, "/", http.StatusOK, map[string]string{"Origin": "https://evil.com", "Authorization": "Bearer x"})
+	if header.Get("Access-Control-Allow-Origin") != "" || header.Get("X-Public") != "" {
+		t.Errorf("Did not expect Origin or absent header rules to match, got %v", header)
+	}
+}
+
+func TestStatusListUnmarshal(t *testing.T) {
+	var config HeaderConfig
+	if err := json.Unmarshal([]byte(`{"status": [404, "5xx"]}`), &config); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(config.Status) != 2 || config.Status[0] != "404" || config.Status[1] != "5xx" {
+		t.Errorf("Unexpected status list %v", config.Status)
+	}
+	if err := json.Unmarshal([]byte(`{"status": [true]}`), &config); err == nil {
+		t.Error("Expected error for invalid status")
+	}
+	if err := (HeaderConfig{Status: StatusList{"4x"}}).validate(); err == nil {
+		t.Error("Expected validation error for malformed status")
+	}
+}
+
+func TestReloadHeaderConfig(t *testing.T) {
+	previous := headerConfigs.Load()
+	defer headerConfigs.Store(previous)
+
+	path := writeConfigFile(t, "headers.json", `{"configs": [{"path": "*", "headers": [{"key": "X-Version", "value": "1"}]}]}`)
+	if valid, err := initHeaderConfig(path); !valid || err != nil {
+		t.Fatalf("initHeaderConfig failed: %v, %v", valid, err)
+	}
+	current := func() string {
+		handler := customHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Header().Get("X-Version")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"configs": [{"path": "*", "headers": [{"key": "X-Version", "value": "2"}]}]}`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	reloadHeaderConfig(path)
+	if got := current(); got != "2" {
+		t.Errorf("Expected reloaded rules, got %q", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"configs": [{"path": "*", "headers": [{"key": "X-Version", "value": "3"}]`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	reloadHeaderConfig(path)
+	if got := current(); got != "2" {
+		t.Errorf("Expected previous rules to stay after an invalid change, got %q", got)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	reloadHeaderConfig(path)
+	if got := current(); got != "" {
+		t.Errorf("Expected no rules after the file was removed, got %q", got)
+	}
+}
+
+func TestWatchHeaderConfig(t *testing.T) {
+	previous := headerConfigs.Load()
+	defer headerConfigs.Store(previous)
+
+	path := writeConfigFile(t, "headers.yaml", "configs: []\n")
+	if _, err := initHeaderConfig(path); err != nil {
+		t.Fatalf("initHeaderConfig failed: %v", err)
+	}
+	stop := watchHeaderConfig(path, 10*time.Millisecond)
+	defer stop()
+
+	if err := os.WriteFile(path, []byte("configs:\n  - headers:\n      - key: X-Watched\n        value: yes\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(headerConfigs.Load().Configs) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected header config to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiffHeaderConfigs(t *testing.T) {
+	a := HeaderConfig{Path: "/a/"}
+	b := HeaderConfig{Path: "/b/"}
+	c := HeaderConfig{Path: "/c/"}
+	added, removed := diffHeaderConfigs(&HeaderConfigArray{Configs: []HeaderConfig{a, b, b}}, &HeaderConfigArray{Configs: []HeaderConfig{b, c}})
+	if len(added) != 1 || !strings.Contains(added[0], `"/c/"`) {
+		t.Errorf("Expected /c/ to be added, got %v", added)
+	}
+	if len(removed) != 2 || !strings.Contains(removed[0], `"/a/"`) || !strings.Contains(removed[1], `"/b/"`) {
+		t.Errorf("Expected /a/ and one /b/ to be removed, got %v", removed)
+	}
+	if added, removed := diffHeaderConfigs(nil, &HeaderConfigArray{Configs: []HeaderConfig{a}}); len(added) != 1 || len(removed) != 0 {
+		t.Errorf("Expected everything to be added on first load, got %v %v", added, removed)
+	}
+}
+
+func TestHeaderOperationsAndPriority(t *testing.T) {
+	previous := headerConfigs.Load()
+	defer headerConfigs.Store(previous)
+
+	path := writeConfigFile(t, "headers.yaml", `
+configs:
+  - priority: 10
+    headers:
+      - key: Cache-Control
+        value: no-store
+  - path: /static/
+    headers:
+      - key: Cache-Control
+        value: immutable
+      - key: Link
+        value: </app.css>; rel=preload
+        operation: add
+  - path: /static/
+    headers:
+      - key: Link
+        value: </app.js>; rel=preload
+        operation: add
+      - key: X-Frame-Options
+        value: SAMEORIGIN
+        operation: setIfMissing
+      - key: X-Powered-By
+        operation: delete
+`)
+	if _, err := initHeaderConfig(path); err != nil {
+		t.Fatalf("initHeaderConfig failed: %v", err)
+	}
+	if first := headerConfigs.Load().Configs[0]; first.Path != "/static/" {
+		t.Errorf("Expected rules to be sorted by priority, got %+v first", first)
+	}
+
+	handler := customHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Powered-By", "goStaticEnv")
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/static/app.js", nil))
+	header := rec.Header()
+
+	if got := header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Expected higher priority rule to win, got %q", got)
+	}
+	if got := header.Values("Link"); len(got) != 2 || got[0] != "</app.css>; rel=preload" || got[1] != "</app.js>; rel=preload" {
+		t.Errorf("Expected both Link headers in rule order, got %v", got)
+	}
+	if got := header.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("Expected setIfMissing to keep the existing value, got %q", got)
+	}
+	if _, ok := header["X-Powered-By"]; ok {
+		t.Error("Expected X-Powered-By to be deleted")
+	}
+
+	if err := (HeaderConfig{Headers: []HeaderDefiniton{{Key: "X", Operation: "replace"}}}).validate(); err == nil {
+		t.Error("Expected validation error for unknown operation")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// contentCache keeps substituted file contents in memory, bounded by a byte
+// ceiling and evicting the least recently used entries first. A nil cache is
+// valid and never stores anything.
+type contentCache struct {
+	mu         sync.Mutex
+	maxBytes   int64
+	size       int64
+	generation uint64
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type cacheEntry struct {
+	name    string
+	modTime time.Time
+	srcSize int64
+	content *renderedContent
+}
+
+// renderedContent is a substituted file with the strong ETag of its bytes.
+// substituted is false if the output is identical to the source file.
+type renderedContent struct {
+	data        []byte
+	etag        string
+	substituted bool
+}
+
+func newContentCache(maxBytes int64) *contentCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &contentCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the cached content for name if it was produced from a source
+// file with the same modification time and size.
+func (c *contentCache) get(name string, modTime time.Time, srcSize int64) (*renderedContent, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[name]
+	if !ok {
+		log.Debug().Str("path", name).Msg("Env cache miss")
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.modTime.Equal(modTime) || entry.srcSize != srcSize {
+		log.Debug().Str("path", name).Msg("Env cache stale")
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	log.Debug().Str("path", name).Msg("Env cache hit")
+	return entry.content, true
+}
+
+// currentGeneration returns a token that changes on every purge. Content
+// produced before a purge is not stored by put.
+func (c *contentCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *contentCache) put(name string, modTime time.Time, srcSize int64, generation uint64, content *renderedContent) {
+	if c == nil || int64(len(content.data)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if elem, ok := c.entries[name]; ok {
+		c.remove(elem)
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name: name, modTime: modTime, srcSize: srcSize, content: content})
+	c.size += int64(len(content.data))
+
+	for c.size > c.maxBytes {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		log.Debug().Str("path", oldest.Value.(*cacheEntry).name).Msg("Env cache evict")
+		c.remove(oldest)
+	}
+}
+
+// purge drops every cached entry.
+func (c *contentCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+	c.generation++
+	log.Debug().Msg("Env cache purged")
+}
+
+func (c *contentCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.name)
+	c.size -= int64(len(entry.content.data))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContentCacheGetPut(t *testing.T) {
+	cache := newContentCache(1024)
+	now := time.Now()
+
+	if _, ok := cache.get("/a.txt", now, 3); ok {
+		t.Error("Expected miss on empty cache")
+	}
+
+	cache.put("/a.txt", now, 3, 0, &renderedContent{data: []byte("abc")})
+	content, ok := cache.get("/a.txt", now, 3)
+	if !ok || string(content.data) != "abc" {
+		t.Errorf("Expected hit with %q, got %+v (hit=%v)", "abc", content, ok)
+	}
+
+	if _, ok := cache.get("/a.txt", now.Add(time.Second), 3); ok {
+		t.Error("Expected miss after modification time changed")
+	}
+	if _, ok := cache.get("/a.txt", now, 3); ok {
+		t.Error("Expected stale entry to be dropped")
+	}
+}
+
+func TestContentCacheEviction(t *testing.T) {
+	cache := newContentCache(10)
+	now := time.Now()
+
+	cache.put("/a", now, 4, 0, &renderedContent{data: []byte("aaaa")})
+	cache.put("/b", now, 4, 0, &renderedContent{data: []byte("bbbb")})
+	// Touch a so b becomes the least recently used entry
+	cache.get("/a", now, 4)
+	cache.put("/c", now, 4, 0, &renderedContent{data: []byte("cccc")})
+
+	if _, ok := cache.get("/b", now, 4); ok {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+	if _, ok := cache.get("/a", now, 4); !ok {
+		t.Error("Expected recently used entry to survive eviction")
+	}
+	if _, ok := cache.get("/c", now, 4); !ok {
+		t.Error("Expected newest entry to be cached")
+	}
+	if cache.size > cache.maxBytes {
+		t.Errorf("Cache size %d exceeds ceiling %d", cache.size, cache.maxBytes)
+	}
+
+	cache.put("/big", now, 11, 0, &renderedContent{data: []byte("01234567890")})
+	if _, ok := cache.get("/big", now, 11); ok {
+		t.Error("Expected entry larger than the ceiling not to be cached")
+	}
+}
+
+func TestContentCachePurgeGeneration(t *testing.T) {
+	cache := newContentCache(1024)
+	now := time.Now()
+
+	generation := cache.currentGeneration()
+	cache.purge()
+	cache.put("/a", now, 1, generation, &renderedContent{data: []byte("a")})
+	if _, ok := cache.get("/a", now, 1); ok {
+		t.Error("Expected content produced before a purge not to be cached")
+	}
+
+	cache.put("/a", now, 1, cache.currentGeneration(), &renderedContent{data: []byte("a")})
+	if _, ok := cache.get("/a", now, 1); !ok {
+		t.Error("Expected content produced after a purge to be cached")
+	}
+}
+
+func TestContentCacheDisabled(t *testing.T) {
+	cache := newContentCache(0)
+	if cache != nil {
+		t.Fatal("Expected nil cache for zero ceiling")
+	}
+	cache.put("/a", time.Now(), 1, 0, &renderedContent{data: []byte("a")})
+	if _, ok := cache.get("/a", time.Now(), 1); ok {
+		t.Error("Expected nil cache to never hit")
+	}
+	cache.purge()
+}
+
+func TestEnvFileSystemUsesCache(t *testing.T) {
+	dir := t.TempDir()
+	testFile := filepath.Join(dir, "test.txt")
+	if err := os.WriteFile(testFile, []byte("value=${CACHE_VAR}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	os.Setenv("CACHE_VAR", "first")
+	defer os.Unsetenv("CACHE_VAR")
+
+	fs := EnvFileSystem{fs: http.Dir(dir), cache: newContentCache(1024)}
+	read := func() string {
+		f, err := fs.Open("/test.txt")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		return string(b)
+	}
+
+	if got := read(); got != "value=first" {
+		t.Errorf("Expected %q, got %q", "value=first", got)
+	}
+
+	// A cached result is served even though the variable changed
+	os.Setenv("CACHE_VAR", "second")
+	if got := read(); got != "value=first" {
+		t.Errorf("Expected cached %q, got %q", "value=first", got)
+	}
+
+	fs.cache.purge()
+	if got := read(); got != "value=second" {
+		t.Errorf("Expected %q after purge, got %q", "value=second", got)
+	}
+}
+
+func TestEnvFileSystemCachesFallbackOnce(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("${CACHE_FALLBACK:=app}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	cache := newContentCache(1024)
+	fs := EnvFileSystem{fs: fallback{defaultPath: "index.html", fs: http.Dir(dir)}, cache: cache}
+	for _, name := range []string{"/index.html", "/deep/link/1", "/deep/link/2", "/other"} {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open %s failed: %v", name, err)
+		}
+		if b, _ := io.ReadAll(f); string(b) != "app" {
+			t.Errorf("Expected fallback content for %s, got %q", name, b)
+		}
+		f.Close()
+	}
+	if len(cache.entries) != 1 {
+		t.Errorf("Expected a single cache entry for the fallback file, got %d", len(cache.entries))
+	}
+}
@@ -4,15 +4,27 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"time"
 )
 
+// EnvFileSystem substitutes environment variables in the files of fs. Sites
+// that share a cache use different cacheKeys to keep their entries apart, and
+// sites below the static files path set filterPrefix to their path in it, so
+// the include/exclude rules match the same files as for the main site.
 type EnvFileSystem struct {
-	fs http.FileSystem
+	fs           http.FileSystem
+	cache        *contentCache
+	cacheKey     string
+	maxSize      int64
+	filter       envFilter
+	filterPrefix string
+	autoEscape   bool
 }
 
 type EnvFile struct {
@@ -20,17 +32,34 @@ type EnvFile struct {
 	file         http.File
 	info         os.FileInfo
 	replacedSize int64
+	etag         string
+	substituted  bool
 }
 
 type EnvFileInfo struct {
 	os.FileInfo
-	size int64
+	size        int64
+	substituted bool
 }
 
 func (e EnvFileInfo) Size() int64 {
 	return e.size
 }
 
+// ModTime of substituted files is the later of the source file's modification
+// time and the last change of the variable values, so Last-Modified moves when
+// either changes. Files without placeholders keep their own time.
+func (e EnvFileInfo) ModTime() time.Time {
+	modTime := e.FileInfo.ModTime()
+	if !e.substituted {
+		return modTime
+	}
+	if changed := varsChangedAt.Load(); changed > modTime.UnixNano() {
+		return time.Unix(0, changed)
+	}
+	return modTime
+}
+
 func (f *EnvFile) Close() error {
 	if f.file == nil {
 		return nil
@@ -39,7 +68,7 @@ func (f *EnvFile) Close() error {
 }
 
 func (f *EnvFile) Stat() (os.FileInfo, error) {
-	return EnvFileInfo{FileInfo: f.info, size: f.replacedSize}, nil
+	return EnvFileInfo{FileInfo: f.info, size: f.replacedSize, substituted: f.substituted}, nil
 }
 
 func (f *EnvFile) Readdir(count int) ([]os.FileInfo, error) {
@@ -49,42 +78,68 @@ func (f *EnvFile) Readdir(count int) ([]os.FileInfo, error) {
 	return f.file.Readdir(count)
 }
 
-var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:=([^}]*))?}`)
-
 var fileExtensions = map[string]bool{
 	"html": true, "js": true, "css": true, "json": true, "txt": true,
 	"md": true, "xml": true, "yml": true, "yaml": true, "log": true, "bak": true,
 }
 
-func replaceEnvVars(content string) string {
-	return envVarPattern.ReplaceAllStringFunc(content, func(match string) string {
-		groups := envVarPattern.FindStringSubmatch(match)
-		if len(groups) < 2 {
-			return match
-		}
-
-		varName := groups[1]
-		defaultValue := ""
-		hasDefault := len(groups) > 3 && groups[3] != ""
+// binaryExtensions lists file types that never contain placeholders and are
+// served straight from disk, in addition to anything with a media MIME type.
+var binaryExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true, ".ico": true, ".bmp": true,
+	".mp4": true, ".webm": true, ".mov": true, ".mp3": true, ".ogg": true, ".wav": true, ".flac": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".zip": true, ".gz": true, ".br": true, ".zst": true, ".tar": true, ".7z": true,
+	".pdf": true, ".wasm": true, ".exe": true, ".bin": true, ".dll": true, ".so": true,
+}
 
-		if hasDefault {
-			defaultValue = groups[3]
-		}
+func isBinaryFile(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if binaryExtensions[ext] {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return false
+	}
+	switch strings.SplitN(mediaType, "/", 2)[0] {
+	case "image":
+		return mediaType != "image/svg+xml"
+	case "audio", "video", "font":
+		return true
+	}
+	return mediaType == "application/octet-stream"
+}
 
-		if value, exists := os.LookupEnv(varName); exists {
-			return value
-		}
+// shouldSubstitute reports whether a file is run through replaceEnvVars or
+// served untouched from the underlying file system. resolved is the file that
+// was actually opened, e.g. the fallback file for a missing one.
+func (e EnvFileSystem) shouldSubstitute(resolved string, stat os.FileInfo) bool {
+	if isBinaryFile(resolved) {
+		return false
+	}
+	if !e.filter.includePath(strings.TrimPrefix(path.Clean("/"+e.filterPrefix+"/"+resolved), "/")) {
+		return false
+	}
+	return e.maxSize <= 0 || stat.Size() <= e.maxSize
+}
 
-		if hasDefault || (len(groups) > 2 && groups[2] == ":=") {
-			return defaultValue
-		}
+func replaceEnvVars(content string) string {
+	return replaceEnvVarsEscaped(content, "")
+}
 
-		return match
-	})
+// replaceEnvVarsEscaped substitutes placeholders and escapes each inserted
+// value with the placeholder's modifier, or with defaultEscape if it has none.
+func replaceEnvVarsEscaped(content, defaultEscape string) string {
+	if !strings.Contains(content, "${") {
+		return content
+	}
+	x := expander{defaultEscape: defaultEscape}
+	return x.render(parseTemplate(content), false)
 }
 
 func (e EnvFileSystem) Open(name string) (http.File, error) {
-	file, err := e.fs.Open(name)
+	file, resolved, err := openResolved(e.fs, name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %s: %w", name, err)
 	}
@@ -95,23 +150,37 @@ func (e EnvFileSystem) Open(name string) (http.File, error) {
 		return nil, fmt.Errorf("failed to stat file %s: %w", name, err)
 	}
 
-	if stat.IsDir() {
+	if stat.IsDir() || !e.shouldSubstitute(resolved, stat) {
 		return file, nil
 	}
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to read file %s: %w", name, err)
+	// Key by the opened file, so every deep link answered by the fallback
+	// shares one entry
+	key := e.cacheKey + path.Clean("/"+resolved)
+	generation := e.cache.currentGeneration()
+	content, cached := e.cache.get(key, stat.ModTime(), stat.Size())
+	if !cached {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read file %s: %w", name, err)
+		}
+		escaper := ""
+		if e.autoEscape {
+			escaper = defaultEscaper(resolved)
+		}
+		rendered := replaceEnvVarsEscaped(string(data), escaper)
+		content = newRenderedContent([]byte(rendered), rendered != string(data))
+		e.cache.put(key, stat.ModTime(), stat.Size(), generation, content)
 	}
 
-	processedContent := replaceEnvVars(string(data))
-
 	return &EnvFile{
-		Reader:       bytes.NewReader([]byte(processedContent)),
+		Reader:       bytes.NewReader(content.data),
 		file:         file,
 		info:         stat,
-		replacedSize: int64(len(processedContent)),
+		replacedSize: int64(len(content.data)),
+		etag:         content.etag,
+		substituted:  content.substituted,
 	}, nil
 }
 
@@ -138,6 +207,20 @@ func matchPattern(path, pattern string, isInclude bool) bool {
 		return true
 	}
 
+	if strings.Contains(pattern, "**") {
+		// Match the path itself or anything inside a matching directory
+		if globMatch(pattern, path) || globMatch(pattern+"/**", path) {
+			return true
+		}
+		if isInclude {
+			prefix := strings.TrimSuffix(pattern[:strings.Index(pattern, "**")], "/")
+			if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") || strings.HasPrefix(prefix, path+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
 	if strings.ContainsAny(pattern, "*?[]") {
 		if matched, _ := filepath.Match(pattern, path); matched {
 			return true
@@ -184,6 +267,34 @@ func matchPattern(path, pattern string, isInclude bool) bool {
 	return false
 }
 
+// globMatch matches a slash separated path against a glob pattern in which a
+// "**" segment matches any number of path segments, including none. Other
+// segments use path.Match syntax.
+func globMatch(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(parts); i >= 0; i-- {
+				if matchSegments(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], parts[0]); !matched {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
 func shouldInclude(path string, includePatterns, excludePatterns []string, isFile bool) bool {
 	for _, pattern := range excludePatterns {
 		if matchPattern(path, pattern, false) {
@@ -231,8 +342,7 @@ func matchesFilePattern(filePath, pattern string) bool {
 	}
 
 	if strings.Contains(pattern, "/") && strings.Contains(pattern, ".") {
-		matched, _ := filepath.Match(pattern, filePath)
-		return matched
+		return globMatch(pattern, filePath)
 	}
 
 	dir := filepath.Dir(filePath)
@@ -248,88 +358,61 @@ func hasFilePatterns(patterns []string) bool {
 	return false
 }
 
-func checkEnvVarsInFiles(root, includeDirs, excludeDirs string) error {
-	if root == "" {
-		return fmt.Errorf("root path cannot be empty")
-	}
-
-	includePatterns := parsePatterns(includeDirs)
-	excludePatterns := parsePatterns(excludeDirs)
-	hasFilePats := hasFilePatterns(includePatterns)
-	missing := make(map[string]struct{})
-
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-
-		relPath, err := filepath.Rel(root, path)
-		if err != nil {
-			return nil
-		}
-		relPath = filepath.ToSlash(relPath)
-
-		if info.IsDir() {
-			if relPath == "." {
-				return nil
-			}
+// envFilter holds the parsed --env-include and --env-exclude patterns. The
+// zero value includes everything.
+type envFilter struct {
+	include         []string
+	exclude         []string
+	hasFilePatterns bool
+}
 
-			if hasFilePats {
-				if !shouldInclude(relPath, nil, excludePatterns, false) {
-					return filepath.SkipDir
-				}
-				return nil
-			}
+func newEnvFilter(includes, excludes string) envFilter {
+	includePatterns := parsePatterns(includes)
+	return envFilter{
+		include:         includePatterns,
+		exclude:         parsePatterns(excludes),
+		hasFilePatterns: hasFilePatterns(includePatterns),
+	}
+}
 
-			if !shouldInclude(relPath, includePatterns, excludePatterns, false) {
-				return filepath.SkipDir
-			}
-			return nil
-		}
+// includeDir reports whether a directory should be descended into. When file
+// patterns are included, directories are only pruned by the exclude list.
+func (f envFilter) includeDir(relPath string) bool {
+	if f.hasFilePatterns {
+		return shouldInclude(relPath, nil, f.exclude, false)
+	}
+	return shouldInclude(relPath, f.include, f.exclude, false)
+}
 
-		if !shouldInclude(relPath, includePatterns, excludePatterns, true) {
-			return nil
-		}
+func (f envFilter) includeFile(relPath string) bool {
+	return shouldInclude(relPath, f.include, f.exclude, true)
+}
 
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return nil
+// includePath applies the same decisions as a directory walk from the root
+// would to a single slash separated file path.
+func (f envFilter) includePath(relPath string) bool {
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return true
+	}
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if !f.includeDir(strings.Join(parts[:i], "/")) {
+			return false
 		}
+	}
+	return f.includeFile(relPath)
+}
 
-		matches := envVarPattern.FindAllStringSubmatch(string(data), -1)
-		for _, match := range matches {
-			if len(match) < 2 {
-				continue
-			}
-
-			varName := match[1]
-			defaultValue := ""
-			hasDefault := len(match) > 3 && match[3] != ""
-
-			if hasDefault {
-				defaultValue = match[3]
-			}
-
-			if _, exists := os.LookupEnv(varName); !exists {
-				if defaultValue == "" && (len(match) <= 2 || match[2] != ":=") {
-					missing[varName] = struct{}{}
-				}
-			}
-		}
-		return nil
-	})
+func checkEnvVarsInFiles(root, includeDirs, excludeDirs string) error {
+	return checkEnvVarsInRoots([]string{root}, includeDirs, excludeDirs)
+}
 
+// checkEnvVarsInRoots scans every root, such as the static files path and the
+// vhost roots, and reports each missing variable once.
+func checkEnvVarsInRoots(roots []string, includeDirs, excludeDirs string) error {
+	report, err := scanEnvVarsRoots(roots, includeDirs, excludeDirs, nil)
 	if err != nil {
-		return fmt.Errorf("error walking directory tree: %w", err)
+		return err
 	}
-
-	if len(missing) > 0 {
-		keys := make([]string, 0, len(missing))
-		for key := range missing {
-			keys = append(keys, key)
-		}
-		return fmt.Errorf("missing environment variables: %v", keys)
-	}
-
-	return nil
+	return missingVarsError("missing environment variables", report.Missing)
 }
@@ -1055,18 +1055,119 @@ func TestEnvFileSystemWithDifferentFileExtensions(t *testing.T) {
 		}
 	}
 
-	// Test that binary files are also processed (current implementation processes all files)
-	// Note: This documents current behavior - binary files get processed too
+	// Binary files are served straight from the underlying file system
 	for filename := range binaryFiles {
 		f, err := fs.Open(filename)
 		if err != nil {
 			t.Errorf("Failed to open %s: %v", filename, err)
 			continue
 		}
+		if _, ok := f.(*EnvFile); ok {
+			t.Errorf("File %s should not be processed for environment variables", filename)
+		}
 		f.Close()
 	}
 }
 
+func TestEnvFileSystemStreamsLargeFiles(t *testing.T) {
+	dir := t.TempDir()
+	small := "small ${VAR}"
+	large := "large ${VAR} " + strings.Repeat("x", 100)
+	if err := os.WriteFile(filepath.Join(dir, "small.txt"), []byte(small), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "large.txt"), []byte(large), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	os.Setenv("VAR", "value")
+	defer os.Unsetenv("VAR")
+
+	fs := EnvFileSystem{fs: http.Dir(dir), maxSize: 50}
+
+	f, err := fs.Open("small.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	b, _ := io.ReadAll(f)
+	f.Close()
+	if string(b) != "small value" {
+		t.Errorf("Expected small file to be processed, got %q", string(b))
+	}
+
+	f, err = fs.Open("large.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	if _, ok := f.(*os.File); !ok {
+		t.Errorf("Expected large file to be served from disk, got %T", f)
+	}
+	b, _ = io.ReadAll(f)
+	if string(b) != large {
+		t.Errorf("Expected large file content untouched, got %q", string(b))
+	}
+}
+
+func TestIsBinaryFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"index.html", false},
+		{"app.js", false},
+		{"style.css", false},
+		{"logo.svg", false},
+		{"notes.bak", false},
+		{"noextension", false},
+		{"photo.JPG", true},
+		{"font.woff2", true},
+		{"movie.mp4", true},
+		{"module.wasm", true},
+		{"app.js.gz", true},
+	}
+
+	for _, tt := range tests {
+		if got := isBinaryFile(tt.name); got != tt.want {
+			t.Errorf("isBinaryFile(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnvFileSystemBinaryCheckUsesFallbackFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(`var a="${FALLBACK_BIN:=x}"`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "logo.png"), []byte("${FALLBACK_BIN}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	os.Setenv("FALLBACK_BIN", "value")
+	defer os.Unsetenv("FALLBACK_BIN")
+
+	for _, defaultPath := range []string{"/index.html", "index.html"} {
+		fs := EnvFileSystem{fs: fallback{defaultPath: defaultPath, fs: http.Dir(dir)}}
+		tests := map[string]string{
+			"/missing.png":  `var a="value"`,
+			"/favicon.ico":  `var a="value"`,
+			"/deep/x":       `var a="value"`,
+			"/logo.png":     "${FALLBACK_BIN}",
+			"/a/b/font.ttf": `var a="value"`,
+		}
+		for name, want := range tests {
+			f, err := fs.Open(name)
+			if err != nil {
+				t.Fatalf("Open %s failed: %v", name, err)
+			}
+			b, _ := io.ReadAll(f)
+			f.Close()
+			if string(b) != want {
+				t.Errorf("fallback %s: %s = %q, want %q", defaultPath, name, b, want)
+			}
+		}
+	}
+}
+
 func TestEnvFileStatSize(t *testing.T) {
 	dir := t.TempDir()
 	originalContent := "Original content with ${VAR} variable"
@@ -1182,3 +1283,216 @@ func TestRegexPatternMatchingLimits(t *testing.T) {
 		}
 	}
 }
+
+func TestEnvFileSystemHonorsIncludeExclude(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":           "${FILTER_VAR}",
+		"app.js":               "${FILTER_VAR}",
+		"vendor/lib.js":        "${FILTER_VAR}",
+		"src/vendor/deep.html": "${FILTER_VAR}",
+		"src/page.html":        "${FILTER_VAR}",
+	}
+	for name, content := range files {
+		full := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	os.Setenv("FILTER_VAR", "value")
+	defer os.Unsetenv("FILTER_VAR")
+
+	tests := []struct {
+		include   string
+		exclude   string
+		templated map[string]bool
+	}{
+		{"", "vendor", map[string]bool{
+			"index.html": true, "app.js": true, "vendor/lib.js": false, "src/vendor/deep.html": false, "src/page.html": true,
+		}},
+		{"*.html", "", map[string]bool{
+			"index.html": true, "app.js": false, "vendor/lib.js": false, "src/vendor/deep.html": true, "src/page.html": true,
+		}},
+		{"src", "vendor", map[string]bool{
+			"index.html": false, "app.js": false, "vendor/lib.js": false, "src/vendor/deep.html": false, "src/page.html": true,
+		}},
+	}
+
+	for _, tt := range tests {
+		fs := EnvFileSystem{fs: http.Dir(dir), filter: newEnvFilter(tt.include, tt.exclude)}
+		for name, want := range tt.templated {
+			f, err := fs.Open("/" + name)
+			if err != nil {
+				t.Fatalf("Open %s failed: %v", name, err)
+			}
+			b, _ := io.ReadAll(f)
+			f.Close()
+			if got := string(b) == "value"; got != want {
+				t.Errorf("include=%q exclude=%q: %s templated = %v, want %v", tt.include, tt.exclude, name, got, want)
+			}
+		}
+	}
+}
+
+func TestEnvFileSystemFilterUsesFallbackFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":        "${FALLBACK_FILTER}",
+		"vendor/index.html": "${FALLBACK_FILTER}",
+	}
+	for name, content := range files {
+		full := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	os.Setenv("FALLBACK_FILTER", "value")
+	defer os.Unsetenv("FALLBACK_FILTER")
+
+	tests := []struct {
+		defaultPath string
+		include     string
+		exclude     string
+		name        string
+		want        string
+	}{
+		{"/index.html", "", "vendor", "/vendor/deep/link", "value"},
+		{"/index.html", "vendor", "", "/vendor/deep/link", "${FALLBACK_FILTER}"},
+		{"index.html", "", "vendor", "/vendor/deep/link", "${FALLBACK_FILTER}"},
+		{"index.html", "", "vendor", "/app/deep/link", "value"},
+		{"index.html", "vendor", "", "/vendor/deep/link", "value"},
+	}
+
+	for _, tt := range tests {
+		fs := EnvFileSystem{
+			fs:     fallback{defaultPath: tt.defaultPath, fs: http.Dir(dir)},
+			filter: newEnvFilter(tt.include, tt.exclude),
+		}
+		f, err := fs.Open(tt.name)
+		if err != nil {
+			t.Fatalf("Open %s failed: %v", tt.name, err)
+		}
+		b, _ := io.ReadAll(f)
+		f.Close()
+		if string(b) != tt.want {
+			t.Errorf("fallback=%s include=%q exclude=%q: %s = %q, want %q", tt.defaultPath, tt.include, tt.exclude, tt.name, b, tt.want)
+		}
+	}
+}
+
+func TestReplaceEnvVarsShellOperators(t *testing.T) {
+	os.Setenv("OP_SET", "value")
+	os.Setenv("OP_EMPTY", "")
+	defer os.Unsetenv("OP_SET")
+	defer os.Unsetenv("OP_EMPTY")
+
+	tests := []struct {
+		input    string
+		expected string
+		desc     string
+	}{
+		{"${OP_SET:-default}", "value", "default operator with set variable"},
+		{"${OP_EMPTY:-default}", "default", "default operator with empty variable"},
+		{"${OP_UNSET:-default}", "default", "default operator with unset variable"},
+		{"${OP_EMPTY:=default}", "", "assign operator keeps empty variable"},
+		{"${OP_SET:+alt}", "alt", "alternate operator with set variable"},
+		{"${OP_EMPTY:+alt}", "", "alternate operator with empty variable"},
+		{"${OP_UNSET:+alt}", "", "alternate operator with unset variable"},
+		{"${OP_SET:?required}", "value", "required operator with set variable"},
+		{"${OP_EMPTY:?required}", "${OP_EMPTY:?required}", "required operator with empty variable"},
+		{"${OP_UNSET:?required}", "${OP_UNSET:?required}", "required operator with unset variable"},
+		{"$${OP_SET}", "${OP_SET}", "escaped placeholder"},
+		{"$${OP_SET:-default}", "${OP_SET:-default}", "escaped placeholder with operator"},
+		{"$$${OP_SET}", "$${OP_SET}", "escape only consumes one dollar sign"},
+		{"${OP_UNSET:-a|b}", "a|b", "pipe in default"},
+		{"${OP_SET:+<b>|html}", "&lt;b&gt;", "alternate value is escaped"},
+	}
+
+	for _, test := range tests {
+		if got := replaceEnvVars(test.input); got != test.expected {
+			t.Errorf("%s: replaceEnvVars(%q) = %q, want %q", test.desc, test.input, got, test.expected)
+		}
+	}
+}
+
+func TestCheckEnvVarsInFilesShellOperators(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Join([]string{
+		"${OP_REQUIRED:?set OP_REQUIRED to the API origin}",
+		"${OP_OPTIONAL:-fallback}",
+		"${OP_ALTERNATE:+alt}",
+		"$${OP_ESCAPED}",
+		"${OP_EMPTY_REQUIRED:?}",
+	}, "\n")
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	os.Setenv("OP_EMPTY_REQUIRED", "")
+	defer os.Unsetenv("OP_EMPTY_REQUIRED")
+
+	err := checkEnvVarsInFiles(dir, "", "")
+	if err == nil {
+		t.Fatal("Expected error for missing required variables")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "OP_REQUIRED (set OP_REQUIRED to the API origin)") {
+		t.Errorf("Expected custom message for OP_REQUIRED, got %v", msg)
+	}
+	if !strings.Contains(msg, "OP_EMPTY_REQUIRED") {
+		t.Errorf("Expected empty required variable to be reported, got %v", msg)
+	}
+	for _, name := range []string{"OP_OPTIONAL", "OP_ALTERNATE", "OP_ESCAPED"} {
+		if strings.Contains(msg, name) {
+			t.Errorf("Did not expect %s to be reported, got %v", name, msg)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"assets/**/*.woff2", "assets/fonts/a.woff2", true},
+		{"assets/**/*.woff2", "assets/a.woff2", true},
+		{"assets/**/*.woff2", "assets/a/b/c/d.woff2", true},
+		{"assets/**/*.woff2", "other/a.woff2", false},
+		{"**/node_modules", "node_modules", true},
+		{"**/node_modules", "a/b/node_modules", true},
+		{"**", "anything/at/all", true},
+		{"docs/*", "docs/a/b", false},
+		{"docs/*", "docs/a", true},
+	}
+	for _, test := range tests {
+		if got := globMatch(test.pattern, test.name); got != test.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+func TestEnvFilterDoubleStar(t *testing.T) {
+	filter := newEnvFilter("", "**/vendor")
+	if filter.includePath("src/vendor/lib.js") || filter.includePath("vendor/lib.js") {
+		t.Error("Expected files below excluded directories at any depth to be skipped")
+	}
+	if !filter.includePath("src/app.js") {
+		t.Error("Expected other files to be included")
+	}
+
+	filter = newEnvFilter("public/**/*.html", "")
+	if !filter.includePath("public/a/b/index.html") || !filter.includePath("public/index.html") {
+		t.Error("Expected HTML files below public to be included")
+	}
+	if filter.includePath("public/a/app.js") || filter.includePath("src/index.html") {
+		t.Error("Expected other files to be skipped")
+	}
+}
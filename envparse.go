@@ -0,0 +1,247 @@
+package main
+
+import (
+	"strings"
+)
+
+// maxNestingDepth limits how deeply placeholders may be nested in defaults
+// and alternates.
+const maxNestingDepth = 32
+
+// templateNode is either literal text or a placeholder.
+type templateNode struct {
+	text        string
+	placeholder *placeholder
+}
+
+// placeholder is a parsed ${NAME<op><arg>|<escaper>} reference. op is one of
+// ":=", ":-", ":+", ":?" or empty, and arg may contain nested placeholders.
+// raw is the source text, which is kept when the placeholder can't be resolved,
+// and offset is where it starts in the parsed content.
+type placeholder struct {
+	name    string
+	op      string
+	arg     []templateNode
+	escaper string
+	raw     string
+	offset  int
+}
+
+// parseTemplate splits content into text and placeholders. Anything that is
+// not a well-formed placeholder is kept as text, and $${...} produces the
+// literal text ${...}.
+func parseTemplate(content string) []templateNode {
+	nodes, _, _ := parseNodes(content, 0, false, 0)
+	return nodes
+}
+
+// parseNodes scans s from start. Inside a placeholder argument it stops at the
+// first unbalanced } and reports closed, otherwise it runs to the end of s.
+func parseNodes(s string, start int, inArg bool, depth int) ([]templateNode, int, bool) {
+	var nodes []templateNode
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, templateNode{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	braces := 0
+	i := start
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '$' && strings.HasPrefix(s[i:], "$${"):
+			if _, end, ok := parsePlaceholderAt(s, i+1, depth); ok {
+				text.WriteString(s[i+1 : end])
+				i = end
+				continue
+			}
+		case c == '$' && strings.HasPrefix(s[i:], "${"):
+			if p, end, ok := parsePlaceholderAt(s, i, depth); ok {
+				flush()
+				nodes = append(nodes, templateNode{placeholder: p})
+				i = end
+				continue
+			}
+		case inArg && c == '{':
+			braces++
+		case inArg && c == '}':
+			if braces == 0 {
+				flush()
+				return nodes, i, true
+			}
+			braces--
+		}
+		text.WriteByte(c)
+		i++
+	}
+	flush()
+	return nodes, i, false
+}
+
+// parsePlaceholderAt parses the placeholder starting with "${" at s[start]
+// and returns it with the offset just after its closing brace.
+func parsePlaceholderAt(s string, start, depth int) (*placeholder, int, bool) {
+	if depth >= maxNestingDepth {
+		return nil, 0, false
+	}
+
+	i := start + 2
+	nameStart := i
+	for i < len(s) && isNameByte(s[i], i == nameStart) {
+		i++
+	}
+	if i == nameStart || i >= len(s) {
+		return nil, 0, false
+	}
+	p := &placeholder{name: s[nameStart:i]}
+
+	switch {
+	case s[i] == '}':
+		i++
+	case s[i] == '|':
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 || escapers[s[i+1:i+end]] == nil {
+			return nil, 0, false
+		}
+		p.escaper = s[i+1 : i+end]
+		i += end + 1
+	case s[i] == ':' && i+1 < len(s) && strings.IndexByte("=-+?", s[i+1]) >= 0:
+		p.op = s[i : i+2]
+		arg, end, closed := parseNodes(s, i+2, true, depth+1)
+		if !closed {
+			return nil, 0, false
+		}
+		p.arg, p.escaper = splitEscaper(arg)
+		i = end + 1
+	default:
+		return nil, 0, false
+	}
+
+	p.raw = s[start:i]
+	p.offset = start
+	return p, i, true
+}
+
+func isNameByte(c byte, first bool) bool {
+	if c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+// splitEscaper removes a trailing |escaper from a placeholder argument, as in
+// ${VAR:=default|js}. Unknown names are kept as part of the argument.
+func splitEscaper(arg []templateNode) ([]templateNode, string) {
+	if len(arg) == 0 || arg[len(arg)-1].placeholder != nil {
+		return arg, ""
+	}
+	last := arg[len(arg)-1].text
+	pipe := strings.LastIndexByte(last, '|')
+	if pipe < 0 || escapers[last[pipe+1:]] == nil {
+		return arg, ""
+	}
+
+	escaper := last[pipe+1:]
+	arg = arg[:len(arg)-1]
+	if pipe > 0 {
+		arg = append(arg, templateNode{text: last[:pipe]})
+	}
+	return arg, escaper
+}
+
+// expander renders parsed templates against varSource. Only placeholder
+// arguments are nested templates; variable values are plain text.
+type expander struct {
+	defaultEscape string
+	// onUnresolved is called for every placeholder that stays in place, with
+	// a reason when there is more to say than that the variable is missing.
+	onUnresolved func(p *placeholder, reason string)
+}
+
+// render expands nodes. Placeholders without a modifier use the default
+// escaper at the top level only; nested output is escaped once by the
+// placeholder that contains it.
+func (x *expander) render(nodes []templateNode, nested bool) string {
+	var b strings.Builder
+	for _, node := range nodes {
+		if node.placeholder == nil {
+			b.WriteString(node.text)
+			continue
+		}
+		p := node.placeholder
+		value, ok := x.resolve(p)
+		if !ok {
+			b.WriteString(p.raw)
+			continue
+		}
+		escaper := p.escaper
+		if escaper == "" && !nested {
+			escaper = x.defaultEscape
+		}
+		b.WriteString(escapeValue(value, escaper))
+	}
+	return b.String()
+}
+
+// resolve returns the text the placeholder expands to. ok is false when the
+// placeholder cannot be resolved and has to stay in place.
+//
+//	${VAR}          value of VAR if set
+//	${VAR:=default} value of VAR if set, otherwise default
+//	${VAR:-default} value of VAR if set and not empty, otherwise default
+//	${VAR:+alt}     alt if VAR is set and not empty, otherwise empty
+//	${VAR:?message} value of VAR if set and not empty, otherwise unresolved
+func (x *expander) resolve(p *placeholder) (string, bool) {
+	value, exists, ok := x.lookup(p)
+	if !ok {
+		return "", false
+	}
+	switch p.op {
+	case ":=":
+		if exists {
+			return value, true
+		}
+		return x.render(p.arg, true), true
+	case ":-":
+		if exists && value != "" {
+			return value, true
+		}
+		return x.render(p.arg, true), true
+	case ":+":
+		if exists && value != "" {
+			return x.render(p.arg, true), true
+		}
+		return "", true
+	case ":?":
+		if exists && value != "" {
+			return value, true
+		}
+		x.unresolved(p, x.render(p.arg, true))
+		return "", false
+	}
+	if !exists {
+		x.unresolved(p, "")
+	}
+	return value, exists
+}
+
+// lookup fetches the value of a variable. Values are inserted as they are,
+// never parsed as templates. ok is false if the variable is not allowed.
+func (x *expander) lookup(p *placeholder) (value string, exists, ok bool) {
+	if !allowedVars.allowed(p.name) {
+		x.unresolved(p, "not allowed by --env-allow/--env-deny")
+		return "", false, false
+	}
+
+	value, exists = varSource.Lookup(p.name)
+	return value, exists, true
+}
+
+func (x *expander) unresolved(p *placeholder, reason string) {
+	if x.onUnresolved != nil {
+		x.onUnresolved(p, reason)
+	}
+}
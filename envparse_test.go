@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplaceEnvVarsNestedDefaults(t *testing.T) {
+	os.Setenv("NEST_BASE", "https://example.com")
+	os.Setenv("NEST_SET", "set")
+	defer os.Unsetenv("NEST_BASE")
+	defer os.Unsetenv("NEST_SET")
+
+	tests := []struct {
+		input    string
+		expected string
+		desc     string
+	}{
+		{"${NEST_API:=${NEST_BASE}/api}", "https://example.com/api", "nested placeholder in default"},
+		{"${NEST_SET:=${NEST_BASE}/api}", "set", "default is not used when set"},
+		{"${NEST_API:=${NEST_MISSING:-${NEST_BASE}}/v1}", "https://example.com/v1", "multiple levels of nesting"},
+		{"${NEST_API:=${NEST_MISSING}/api}", "${NEST_MISSING}/api", "unresolved nested placeholder is kept"},
+		{`${NEST_CFG:={"a":{"b":1}}}`, `{"a":{"b":1}}`, "balanced braces in default"},
+		{"${NEST_CFG:={}x", "${NEST_CFG:={}x", "unbalanced braces are not a placeholder"},
+		{"${NEST_API:=$${NEST_BASE}}", "${NEST_BASE}", "escaped placeholder in default"},
+		{"${NEST_API:=${NEST_BASE}|url}", "https%3A%2F%2Fexample.com", "modifier applies to nested result"},
+		{"${NEST_SET:+on ${NEST_BASE}}", "on https://example.com", "nested placeholder in alternate"},
+	}
+
+	for _, test := range tests {
+		if got := replaceEnvVars(test.input); got != test.expected {
+			t.Errorf("%s: replaceEnvVars(%q) = %q, want %q", test.desc, test.input, got, test.expected)
+		}
+	}
+}
+
+func TestReplaceEnvVarsNestingLimit(t *testing.T) {
+	input := strings.Repeat("${NEST_DEEP:=", 1000) + "x" + strings.Repeat("}", 1000)
+	got := replaceEnvVars(input)
+	if !strings.Contains(got, "x") || strings.Count(got, "${NEST_DEEP:=") < 1000-maxNestingDepth {
+		t.Errorf("Expected placeholders beyond the nesting limit to be kept as text, got %d levels", strings.Count(got, "${NEST_DEEP:="))
+	}
+}
+
+func TestReplaceEnvVarsValuesAreLiteral(t *testing.T) {
+	os.Setenv("REF_BASE", "https://example.com")
+	os.Setenv("REF_API", "${REF_BASE}/api")
+	os.Setenv("REF_ESCAPED", "Hello $${name}")
+	os.Setenv("REF_JS", "`${REF_BASE}`")
+	defer func() {
+		for _, name := range []string{"REF_BASE", "REF_API", "REF_ESCAPED", "REF_JS"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	tests := map[string]string{
+		"${REF_API}":                     "${REF_BASE}/api",
+		"${REF_ESCAPED}":                 "Hello $${name}",
+		"${REF_JS}":                      "`${REF_BASE}`",
+		"${REF_MISSING:=${REF_API}}":     "${REF_BASE}/api",
+		"${REF_MISSING:-${REF_ESCAPED}}": "Hello $${name}",
+	}
+	for input, expected := range tests {
+		if got := replaceEnvVars(input); got != expected {
+			t.Errorf("Expected value to be inserted verbatim: replaceEnvVars(%q) = %q, want %q", input, got, expected)
+		}
+	}
+}
+
+func TestCheckEnvVarsInFilesNestedReferences(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Join([]string{
+		"${NESTCHK_API:=${NESTCHK_BASE}/api}",
+		"${NESTCHK_SET:=${NESTCHK_IGNORED}}",
+		"${NESTCHK_VALUE}",
+	}, "\n")
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	os.Setenv("NESTCHK_SET", "set")
+	os.Setenv("NESTCHK_VALUE", "${NESTCHK_IN_VALUE}")
+	defer os.Unsetenv("NESTCHK_SET")
+	defer os.Unsetenv("NESTCHK_VALUE")
+
+	err := checkEnvVarsInFiles(dir, "", "")
+	if err == nil {
+		t.Fatal("Expected error for unresolved nested references")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "NESTCHK_BASE") {
+		t.Errorf("Expected nested reference NESTCHK_BASE to be reported, got %v", msg)
+	}
+	if strings.Contains(msg, "NESTCHK_IGNORED") || strings.Contains(msg, "NESTCHK_API") {
+		t.Errorf("Did not expect defaults that resolve to be reported, got %v", msg)
+	}
+	if strings.Contains(msg, "NESTCHK_IN_VALUE") {
+		t.Errorf("Did not expect placeholders inside values to be reported, got %v", msg)
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	nodes := parseTemplate("a ${B:-x${C}y|js} $${D} ${E")
+	if len(nodes) != 3 {
+		t.Fatalf("Expected 3 nodes, got %d: %+v", len(nodes), nodes)
+	}
+	if nodes[0].text != "a " {
+		t.Errorf("Unexpected leading text %q", nodes[0].text)
+	}
+	p := nodes[1].placeholder
+	if p == nil || p.name != "B" || p.op != ":-" || p.escaper != "js" || p.raw != "${B:-x${C}y|js}" {
+		t.Fatalf("Unexpected placeholder %+v", p)
+	}
+	if len(p.arg) != 3 || p.arg[0].text != "x" || p.arg[1].placeholder == nil || p.arg[1].placeholder.name != "C" || p.arg[2].text != "y" {
+		t.Errorf("Unexpected placeholder argument %+v", p.arg)
+	}
+	if nodes[2].text != " ${D} ${E" {
+		t.Errorf("Unexpected trailing text %q", nodes[2].text)
+	}
+}
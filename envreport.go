@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// envReport describes every placeholder found by the startup scan.
+type envReport struct {
+	Placeholders []reportPlaceholder `json:"placeholders"`
+	Missing      []reportMissing     `json:"missing"`
+}
+
+// reportPlaceholder aggregates the occurrences of one variable. HasDefault and
+// Resolved are only true if they hold for every occurrence.
+type reportPlaceholder struct {
+	Name        string             `json:"name"`
+	HasDefault  bool               `json:"hasDefault"`
+	Resolved    bool               `json:"resolved"`
+	Occurrences []reportOccurrence `json:"occurrences"`
+}
+
+type reportOccurrence struct {
+	File       string `json:"file"`
+	Line       int    `json:"line,omitempty"`
+	Text       string `json:"text"`
+	HasDefault bool   `json:"hasDefault"`
+	Resolved   bool   `json:"resolved"`
+}
+
+// reportMissing is a variable that leaves a placeholder unresolved in the
+// served output, with the reason if there is more to it than being unset.
+type reportMissing struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// scanEnvVars walks root with the include/exclude rules and reports every
+// placeholder. Nested placeholders are listed too; they only count as missing
+// when the default containing them is actually used.
+func scanEnvVars(root, includeDirs, excludeDirs string) (*envReport, error) {
+	return scanEnvVarsRoots([]string{root}, includeDirs, excludeDirs, nil)
+}
+
+// headerSource is a config file with headers whose keys and values are
+// substituted, such as the header config or the vhost config. name is used
+// in errors and path in the report.
+type headerSource struct {
+	name    string
+	path    string
+	headers []HeaderDefiniton
+}
+
+// scanEnvVarsRoots reports the placeholders of every root and of the header
+// sources, which is what the startup check covers. Files in the first root are
+// listed relative to it and files in other roots with their full path. Header
+// placeholders are listed under the path of their source, without a line.
+func scanEnvVarsRoots(roots []string, includeDirs, excludeDirs string, headers []headerSource) (*envReport, error) {
+	builder := newReportBuilder()
+	filter := newEnvFilter(includeDirs, excludeDirs)
+	for i, root := range roots {
+		if root == "" {
+			return nil, fmt.Errorf("root path cannot be empty")
+		}
+		prefix := ""
+		if i > 0 {
+			prefix = filepath.ToSlash(root) + "/"
+		}
+		if err := builder.scanRoot(root, prefix, filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, source := range headers {
+		for _, header := range source.headers {
+			builder.add(source.path, header.Key, false)
+			builder.add(source.path, header.Value, false)
+		}
+	}
+	return builder.report(), nil
+}
+
+// reportBuilder collects the placeholders and missing variables of a report.
+type reportBuilder struct {
+	placeholders map[string]*reportPlaceholder
+	missing      map[string]string
+	x            expander
+}
+
+func newReportBuilder() *reportBuilder {
+	b := &reportBuilder{
+		placeholders: make(map[string]*reportPlaceholder),
+		missing:      make(map[string]string),
+	}
+	b.x.onUnresolved = func(p *placeholder, reason string) {
+		if b.missing[p.name] == "" {
+			b.missing[p.name] = reason
+		}
+	}
+	return b
+}
+
+// scanRoot adds every file below root that passes filter, named prefix plus
+// its path relative to root.
+func (b *reportBuilder) scanRoot(root, prefix string, filter envFilter) error {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if info.IsDir() {
+			if relPath == "." {
+				return nil
+			}
+
+			if !filter.includeDir(relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !filter.includeFile(relPath) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		b.add(prefix+relPath, string(data), true)
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("error walking directory tree: %w", err)
+	}
+	return nil
+}
+
+// add records the placeholders of content as occurrences in file, with line
+// numbers if withLines is set.
+func (b *reportBuilder) add(file, content string, withLines bool) {
+	nodes := parseTemplate(content)
+	b.x.render(nodes, false)
+
+	lines := newLineIndex(content)
+	walkPlaceholders(nodes, func(p *placeholder) {
+		_, resolved := (&expander{}).resolve(p)
+		hasDefault := p.op != "" && p.op != ":?"
+		entry, ok := b.placeholders[p.name]
+		if !ok {
+			entry = &reportPlaceholder{Name: p.name, HasDefault: true, Resolved: true}
+			b.placeholders[p.name] = entry
+		}
+		entry.HasDefault = entry.HasDefault && hasDefault
+		entry.Resolved = entry.Resolved && resolved
+		occurrence := reportOccurrence{
+			File:       file,
+			Text:       p.raw,
+			HasDefault: hasDefault,
+			Resolved:   resolved,
+		}
+		if withLines {
+			occurrence.Line = lines.line(p.offset)
+		}
+		entry.Occurrences = append(entry.Occurrences, occurrence)
+	})
+}
+
+func (b *reportBuilder) report() *envReport {
+	report := &envReport{
+		Placeholders: make([]reportPlaceholder, 0, len(b.placeholders)),
+		Missing:      make([]reportMissing, 0, len(b.missing)),
+	}
+	for _, entry := range b.placeholders {
+		report.Placeholders = append(report.Placeholders, *entry)
+	}
+	sort.Slice(report.Placeholders, func(i, j int) bool {
+		return report.Placeholders[i].Name < report.Placeholders[j].Name
+	})
+	report.Missing = append(report.Missing, sortedMissing(b.missing)...)
+	return report
+}
+
+// sortedMissing turns a map of missing variable names to reasons into a list
+// sorted by name.
+func sortedMissing(missing map[string]string) []reportMissing {
+	list := make([]reportMissing, 0, len(missing))
+	for name, reason := range missing {
+		list = append(list, reportMissing{Name: name, Reason: reason})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// missingVarsError lists missing variables with their reasons after prefix, or
+// returns nil if there are none.
+func missingVarsError(prefix string, missing []reportMissing) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(missing))
+	for _, m := range missing {
+		key := m.Name
+		if m.Reason != "" {
+			key += " (" + m.Reason + ")"
+		}
+		keys = append(keys, key)
+	}
+	return fmt.Errorf("%s: %s", prefix, strings.Join(keys, ", "))
+}
+
+// writeEnvReport scans the roots and the header sources like the startup
+// check and writes the report as indented JSON. It returns an error if the
+// scan fails or if variables are missing and allowMissing is not set.
+func writeEnvReport(w io.Writer, roots []string, includeDirs, excludeDirs string, headers []headerSource, allowMissing bool) error {
+	report, err := scanEnvVarsRoots(roots, includeDirs, excludeDirs, headers)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	if len(report.Missing) > 0 && !allowMissing {
+		return fmt.Errorf("%d environment variables are missing", len(report.Missing))
+	}
+	return nil
+}
+
+// walkPlaceholders calls fn for every placeholder in nodes, including those
+// nested in defaults and alternates.
+func walkPlaceholders(nodes []templateNode, fn func(p *placeholder)) {
+	for _, node := range nodes {
+		if node.placeholder != nil {
+			fn(node.placeholder)
+			walkPlaceholders(node.placeholder.arg, fn)
+		}
+	}
+}
+
+// lineIndex maps byte offsets to 1-based line numbers.
+type lineIndex []int
+
+func newLineIndex(content string) lineIndex {
+	starts := lineIndex{0}
+	for i := strings.IndexByte(content, '\n'); i >= 0; {
+		starts = append(starts, starts[len(starts)-1]+i+1)
+		i = strings.IndexByte(content[starts[len(starts)-1]:], '\n')
+	}
+	return starts
+}
+
+func (l lineIndex) line(offset int) int {
+	return sort.Search(len(l), func(i int) bool { return l[i] > offset })
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanEnvVarsReport(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "js"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	files := map[string]string{
+		"index.html": "<title>${RPT_TITLE:=Home}</title>\n<p>${RPT_SET}</p>\n<p>${RPT_MISSING}</p>",
+		"js/app.js":  "const api = \"${RPT_API:-${RPT_BASE}/api}\";\nconst key = \"${RPT_KEY:?needed for maps}\";",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	os.Setenv("RPT_SET", "value")
+	defer os.Unsetenv("RPT_SET")
+
+	report, err := scanEnvVars(dir, "", "")
+	if err != nil {
+		t.Fatalf("scanEnvVars failed: %v", err)
+	}
+
+	names := make([]string, 0, len(report.Placeholders))
+	byName := make(map[string]reportPlaceholder)
+	for _, p := range report.Placeholders {
+		names = append(names, p.Name)
+		byName[p.Name] = p
+	}
+	expectedNames := []string{"RPT_API", "RPT_BASE", "RPT_KEY", "RPT_MISSING", "RPT_SET", "RPT_TITLE"}
+	if len(names) != len(expectedNames) {
+		t.Fatalf("Expected placeholders %v, got %v", expectedNames, names)
+	}
+	for i, name := range expectedNames {
+		if names[i] != name {
+			t.Errorf("Expected placeholder %d to be %s, got %s", i, name, names[i])
+		}
+	}
+
+	title := byName["RPT_TITLE"]
+	if !title.HasDefault || !title.Resolved || len(title.Occurrences) != 1 {
+		t.Errorf("Unexpected RPT_TITLE entry: %+v", title)
+	}
+	if occ := title.Occurrences[0]; occ.File != "index.html" || occ.Line != 1 || occ.Text != "${RPT_TITLE:=Home}" {
+		t.Errorf("Unexpected RPT_TITLE occurrence: %+v", occ)
+	}
+
+	if missing := byName["RPT_MISSING"]; missing.HasDefault || missing.Resolved || missing.Occurrences[0].Line != 3 {
+		t.Errorf("Unexpected RPT_MISSING entry: %+v", missing)
+	}
+	if base := byName["RPT_BASE"]; base.Resolved || base.Occurrences[0].File != "js/app.js" || base.Occurrences[0].Line != 1 {
+		t.Errorf("Unexpected RPT_BASE entry: %+v", base)
+	}
+	if key := byName["RPT_KEY"]; key.HasDefault || key.Resolved || key.Occurrences[0].Line != 2 {
+		t.Errorf("Unexpected RPT_KEY entry: %+v", key)
+	}
+
+	expectedMissing := []reportMissing{
+		{Name: "RPT_BASE"},
+		{Name: "RPT_KEY", Reason: "needed for maps"},
+		{Name: "RPT_MISSING"},
+	}
+	if len(report.Missing) != len(expectedMissing) {
+		t.Fatalf("Expected missing %v, got %v", expectedMissing, report.Missing)
+	}
+	for i, want := range expectedMissing {
+		if report.Missing[i] != want {
+			t.Errorf("Expected missing[%d] = %+v, got %+v", i, want, report.Missing[i])
+		}
+	}
+}
+
+func TestWriteEnvReport(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("${RPT_WRITE_MISSING}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := writeEnvReport(&out, []string{dir}, "", "", nil, false); err == nil {
+		t.Error("Expected error when variables are missing")
+	}
+
+	var report envReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("Report is not valid JSON: %v\n%s", err, out.String())
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Name != "RPT_WRITE_MISSING" {
+		t.Errorf("Unexpected missing list: %+v", report.Missing)
+	}
+
+	out.Reset()
+	if err := writeEnvReport(&out, []string{dir}, "", "", nil, true); err != nil {
+		t.Errorf("Expected no error when missing variables are allowed, got %v", err)
+	}
+}
+
+func TestWriteEnvReportRootsAndHeaders(t *testing.T) {
+	base, vhostRoot := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "index.html"), []byte("${RPT_BASE}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(vhostRoot, "index.html"), []byte("x\n${RPT_VHOST}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	headers := []headerSource{
+		{"header config", "headers.json", []HeaderDefiniton{{Key: "X-Api", Value: "${RPT_HEADER}"}}},
+		{"vhost config", "vhosts.yaml", []HeaderDefiniton{{Key: "X-Vhost", Value: "${RPT_VHOST_HEADER}"}}},
+	}
+
+	var out bytes.Buffer
+	if err := writeEnvReport(&out, []string{base, vhostRoot}, "", "", headers, true); err != nil {
+		t.Fatalf("writeEnvReport failed: %v", err)
+	}
+	var report envReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("Report is not valid JSON: %v\n%s", err, out.String())
+	}
+
+	var missing []string
+	for _, m := range report.Missing {
+		missing = append(missing, m.Name)
+	}
+	if strings.Join(missing, ",") != "RPT_BASE,RPT_HEADER,RPT_VHOST,RPT_VHOST_HEADER" {
+		t.Errorf("Unexpected missing list: %v", missing)
+	}
+
+	want := map[string]reportOccurrence{
+		"RPT_BASE":         {File: "index.html", Line: 1},
+		"RPT_VHOST":        {File: filepath.ToSlash(vhostRoot) + "/index.html", Line: 2},
+		"RPT_HEADER":       {File: "headers.json"},
+		"RPT_VHOST_HEADER": {File: "vhosts.yaml"},
+	}
+	for _, p := range report.Placeholders {
+		if len(p.Occurrences) != 1 {
+			t.Errorf("Expected one occurrence of %s, got %+v", p.Name, p.Occurrences)
+			continue
+		}
+		got := p.Occurrences[0]
+		if got.File != want[p.Name].File || got.Line != want[p.Name].Line {
+			t.Errorf("%s: expected %s:%d, got %s:%d", p.Name, want[p.Name].File, want[p.Name].Line, got.File, got.Line)
+		}
+	}
+}
+
+func TestCheckEnvVarsInFilesSortedError(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("${SORT_C} ${SORT_A} ${SORT_B}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	err := checkEnvVarsInFiles(dir, "", "")
+	want := "missing environment variables: SORT_A, SORT_B, SORT_C"
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+}
+
+func TestCheckEnvVarsInRoots(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir()}
+	contents := []string{"${ROOTS_A} ${ROOTS_SHARED}", "${ROOTS_SHARED} ${ROOTS_B}"}
+	for i, root := range roots {
+		if err := os.WriteFile(filepath.Join(root, "index.html"), []byte(contents[i]), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	err := checkEnvVarsInRoots(roots, "", "")
+	want := "missing environment variables: ROOTS_A, ROOTS_B, ROOTS_SHARED"
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// VarSource resolves placeholder names to values.
+type VarSource interface {
+	Lookup(name string) (string, bool)
+}
+
+// varSource is used by replaceEnvVars and checkEnvVarsInFiles. It defaults to
+// the process environment and is replaced in main when file sources are set.
+var varSource VarSource = osEnvSource{}
+
+// varsChangedAt is when the variable values were last loaded, in Unix
+// nanoseconds. Substituted files report it as their modification time if it is
+// newer than the file itself.
+var varsChangedAt atomic.Int64
+
+func markVarsChanged() {
+	varsChangedAt.Store(time.Now().UnixNano())
+}
+
+// allowedVars restricts which variable names placeholders may expand. It is
+// set in main from --env-allow and --env-deny.
+var allowedVars varFilter
+
+// varFilter matches variable names against glob patterns such as PUBLIC_*. An
+// empty allow list allows every name that is not denied.
+type varFilter struct {
+	allow []string
+	deny  []string
+}
+
+func newVarFilter(allow, deny string) (varFilter, error) {
+	filter := varFilter{allow: parsePatterns(allow), deny: parsePatterns(deny)}
+	for _, pattern := range append(append([]string{}, filter.allow...), filter.deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return varFilter{}, fmt.Errorf("invalid variable name pattern %q: %w", pattern, err)
+		}
+	}
+	return filter, nil
+}
+
+// allowed reports whether name may be expanded. Deny patterns win over allow
+// patterns.
+func (f varFilter) allowed(name string) bool {
+	for _, pattern := range f.deny {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, pattern := range f.allow {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type osEnvSource struct{}
+
+func (osEnvSource) Lookup(name string) (string, bool) {
+	return os.LookupEnv(name)
+}
+
+// layeredSource asks each source in turn and returns the first value found.
+type layeredSource []VarSource
+
+func (l layeredSource) Lookup(name string) (string, bool) {
+	for _, source := range l {
+		if value, ok := source.Lookup(name); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// fileSource serves values loaded from a dotenv file, a key-value file or a
+// directory of files. The value set is swapped atomically on reload.
+type fileSource struct {
+	path   string
+	load   func(path string) (map[string]string, error)
+	values atomic.Pointer[map[string]string]
+}
+
+func newFileSource(path string, load func(string) (map[string]string, error)) (*fileSource, error) {
+	values, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	source := &fileSource{path: path, load: load}
+	source.values.Store(&values)
+	return source, nil
+}
+
+func (f *fileSource) Lookup(name string) (string, bool) {
+	value, ok := (*f.values.Load())[name]
+	return value, ok
+}
+
+// reload reads the source again and returns the sorted names of all variables
+// that were added, removed or changed. The previous values are kept on error.
+func (f *fileSource) reload() ([]string, error) {
+	values, err := f.load(f.path)
+	if err != nil {
+		return nil, err
+	}
+	previous := *f.values.Swap(&values)
+
+	var changed []string
+	for key, value := range values {
+		if old, ok := previous[key]; !ok || old != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range previous {
+		if _, ok := values[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// watchVarSources polls every file backed source and reloads it when it
+// changed on disk. onChange is called after new values have been swapped in.
+// Only variable names are logged, never their values.
+func watchVarSources(source VarSource, interval time.Duration, onChange func()) {
+	layers, ok := source.(layeredSource)
+	if !ok {
+		return
+	}
+	for _, layer := range layers {
+		fileSrc, ok := layer.(*fileSource)
+		if !ok {
+			continue
+		}
+		log.Debug().Str("source", fileSrc.path).Dur("interval", interval).Msg("Watching variable source")
+		watchPaths([]string{fileSrc.path}, interval, func() {
+			changed, err := fileSrc.reload()
+			if err != nil {
+				log.Error().Err(err).Str("source", fileSrc.path).Msg("Failed to reload variable source, keeping previous values")
+				return
+			}
+			if len(changed) == 0 {
+				return
+			}
+			log.Info().Str("source", fileSrc.path).Strs("changed", changed).Msg("Reloaded variable source")
+			markVarsChanged()
+			onChange()
+		})
+	}
+}
+
+// newVarSource layers the process environment over the configured files. The
+// process environment wins, followed by the secrets directories, the values
+// files and finally the dotenv files. Within each flag, later paths override
+// earlier ones.
+func newVarSource(dotenvPaths, valuesPaths, dirPaths string) (VarSource, error) {
+	sources := layeredSource{osEnvSource{}}
+	groups := []struct {
+		paths string
+		load  func(string) (map[string]string, error)
+	}{
+		{dirPaths, loadSecretsDir},
+		{valuesPaths, loadValuesFile},
+		{dotenvPaths, loadDotenvFile},
+	}
+	for _, group := range groups {
+		paths := parsePatterns(group.paths)
+		for i := len(paths) - 1; i >= 0; i-- {
+			source, err := newFileSource(paths[i], group.load)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 1 {
+		return osEnvSource{}, nil
+	}
+	return sources, nil
+}
+
+// loadDotenvFile parses KEY=VALUE lines. Blank lines and lines starting with #
+// are ignored, an optional "export " prefix is allowed and values may be
+// single quoted (literal) or double quoted (with \n, \t, \" and \\ escapes).
+func loadDotenvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid line in env file %s:%d: expected KEY=VALUE", path, lineNum)
+		}
+
+		value, err = parseDotenvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in env file %s:%d: %w", path, lineNum, err)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+func parseDotenvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch quote := value[0]; quote {
+	case '\'', '"':
+		end := strings.LastIndexByte(value, quote)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected text after quoted value")
+		}
+		value = value[1:end]
+		if quote == '"' {
+			value = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(value)
+		}
+		return value, nil
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// loadValuesFile reads a flat JSON or YAML object, chosen by file extension.
+// Numbers and booleans are converted to their string form.
+func loadValuesFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read values file %s: %w", path, err)
+	}
+
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported values file %s: expected .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse values file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case nil:
+			values[key] = ""
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("invalid value for %s in values file %s: only strings, numbers and booleans are supported", key, path)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// loadSecretsDir reads one value per file, using the file name as the key, as
+// Kubernetes does for mounted secrets and config maps. Hidden entries such as
+// the ..data link are skipped and a single trailing newline is trimmed.
+func loadSecretsDir(path string) (map[string]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets directory %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		filePath := filepath.Join(path, name)
+		info, err := os.Stat(filePath)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %s: %w", filePath, err)
+		}
+		value := strings.TrimSuffix(string(data), "\n")
+		values[name] = strings.TrimSuffix(value, "\r")
+	}
+	return values, nil
+}
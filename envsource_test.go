@@ -0,0 +1,330 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDotenvFile(t *testing.T) {
+	dir := t.TempDir()
+	envPath := filepath.Join(dir, ".env")
+	content := strings.Join([]string{
+		"# comment",
+		"",
+		"PLAIN=value",
+		"export EXPORTED=yes",
+		"SPACED = padded ",
+		`DOUBLE="line1\nline2"`,
+		`SINGLE='raw\n'`,
+		"INLINE=value # trailing comment",
+		"EMPTY=",
+		"URL=https://example.com/?a=b",
+	}, "\n")
+	if err := os.WriteFile(envPath, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	values, err := loadDotenvFile(envPath)
+	if err != nil {
+		t.Fatalf("loadDotenvFile failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"PLAIN":    "value",
+		"EXPORTED": "yes",
+		"SPACED":   "padded",
+		"DOUBLE":   "line1\nline2",
+		"SINGLE":   `raw\n`,
+		"INLINE":   "value",
+		"EMPTY":    "",
+		"URL":      "https://example.com/?a=b",
+	}
+	for key, want := range expected {
+		if got, ok := values[key]; !ok || got != want {
+			t.Errorf("%s = %q (found=%v), want %q", key, got, ok, want)
+		}
+	}
+
+	if err := os.WriteFile(envPath, []byte("VALID=1\nnot a pair\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := loadDotenvFile(envPath); err == nil || !strings.Contains(err.Error(), ":2") {
+		t.Errorf("Expected error pointing at line 2, got %v", err)
+	}
+}
+
+func TestLoadValuesFile(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "values.json")
+	yamlPath := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(jsonPath, []byte(`{"NAME": "json", "PORT": 8080, "DEBUG": true, "RATIO": 0.5}`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(yamlPath, []byte("NAME: yaml\nPORT: 9090\nDEBUG: false\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	values, err := loadValuesFile(jsonPath)
+	if err != nil {
+		t.Fatalf("loadValuesFile(json) failed: %v", err)
+	}
+	if values["NAME"] != "json" || values["PORT"] != "8080" || values["DEBUG"] != "true" || values["RATIO"] != "0.5" {
+		t.Errorf("Unexpected JSON values: %v", values)
+	}
+
+	values, err = loadValuesFile(yamlPath)
+	if err != nil {
+		t.Fatalf("loadValuesFile(yaml) failed: %v", err)
+	}
+	if values["NAME"] != "yaml" || values["PORT"] != "9090" || values["DEBUG"] != "false" {
+		t.Errorf("Unexpected YAML values: %v", values)
+	}
+
+	nestedPath := filepath.Join(dir, "nested.json")
+	if err := os.WriteFile(nestedPath, []byte(`{"OBJ": {"a": 1}}`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := loadValuesFile(nestedPath); err == nil {
+		t.Error("Expected error for nested values")
+	}
+
+	if _, err := loadValuesFile(filepath.Join(dir, "values.ini")); err == nil {
+		t.Error("Expected error for unsupported extension")
+	}
+}
+
+func TestLoadSecretsDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"API_KEY":     "secret\n",
+		"PLAIN":       "plain",
+		".hidden":     "skip",
+		"WINDOWS_EOL": "crlf\r\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "..data"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+
+	values, err := loadSecretsDir(dir)
+	if err != nil {
+		t.Fatalf("loadSecretsDir failed: %v", err)
+	}
+	if len(values) != 3 {
+		t.Errorf("Expected 3 values, got %v", values)
+	}
+	if values["API_KEY"] != "secret" || values["PLAIN"] != "plain" || values["WINDOWS_EOL"] != "crlf" {
+		t.Errorf("Unexpected secret values: %v", values)
+	}
+}
+
+func TestNewVarSourcePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	dotenv := filepath.Join(dir, ".env")
+	dotenvOverride := filepath.Join(dir, "override.env")
+	valuesPath := filepath.Join(dir, "values.json")
+	secrets := filepath.Join(dir, "secrets")
+
+	if err := os.WriteFile(dotenv, []byte("A=dotenv\nB=dotenv\nC=dotenv\nD=dotenv\nE=dotenv\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(dotenvOverride, []byte("E=override\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(valuesPath, []byte(`{"A": "values", "B": "values", "C": "values"}`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Mkdir(secrets, 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	for _, name := range []string{"A", "B"} {
+		if err := os.WriteFile(filepath.Join(secrets, name), []byte("secrets"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	os.Setenv("A", "env")
+	defer os.Unsetenv("A")
+
+	source, err := newVarSource(dotenv+","+dotenvOverride, valuesPath, secrets)
+	if err != nil {
+		t.Fatalf("newVarSource failed: %v", err)
+	}
+
+	expected := map[string]string{"A": "env", "B": "secrets", "C": "values", "D": "dotenv", "E": "override"}
+	for key, want := range expected {
+		if got, ok := source.Lookup(key); !ok || got != want {
+			t.Errorf("Lookup(%s) = %q (found=%v), want %q", key, got, ok, want)
+		}
+	}
+	if _, ok := source.Lookup("MISSING_SOURCE_VAR"); ok {
+		t.Error("Expected missing variable not to be found")
+	}
+
+	if _, err := newVarSource(filepath.Join(dir, "missing.env"), "", ""); err == nil {
+		t.Error("Expected error for missing dotenv file")
+	}
+}
+
+func TestReplaceEnvVarsUsesVarSource(t *testing.T) {
+	original := varSource
+	defer func() { varSource = original }()
+	fileSrc := &fileSource{}
+	fileSrc.values.Store(&map[string]string{"FROM_FILE": "file"})
+	varSource = layeredSource{osEnvSource{}, fileSrc}
+
+	if got := replaceEnvVars("${FROM_FILE}"); got != "file" {
+		t.Errorf("Expected value from file source, got %q", got)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("${FROM_FILE} ${NOT_IN_FILE}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	err := checkEnvVarsInFiles(dir, "", "")
+	if err == nil || strings.Contains(err.Error(), "FROM_FILE") || !strings.Contains(err.Error(), "NOT_IN_FILE") {
+		t.Errorf("Expected only NOT_IN_FILE to be missing, got %v", err)
+	}
+}
+
+func TestFileSourceReload(t *testing.T) {
+	dir := t.TempDir()
+	envPath := filepath.Join(dir, ".env")
+	if err := os.WriteFile(envPath, []byte("KEEP=1\nCHANGE=old\nREMOVE=x\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	source, err := newFileSource(envPath, loadDotenvFile)
+	if err != nil {
+		t.Fatalf("newFileSource failed: %v", err)
+	}
+
+	if err := os.WriteFile(envPath, []byte("KEEP=1\nCHANGE=new\nADD=y\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	changed, err := source.reload()
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if strings.Join(changed, ",") != "ADD,CHANGE,REMOVE" {
+		t.Errorf("Expected ADD,CHANGE,REMOVE to change, got %v", changed)
+	}
+	if value, _ := source.Lookup("CHANGE"); value != "new" {
+		t.Errorf("Expected reloaded value %q, got %q", "new", value)
+	}
+
+	if err := os.WriteFile(envPath, []byte("broken line\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := source.reload(); err == nil {
+		t.Error("Expected reload error for invalid file")
+	}
+	if value, _ := source.Lookup("CHANGE"); value != "new" {
+		t.Errorf("Expected previous values to be kept after failed reload, got %q", value)
+	}
+}
+
+func TestWatchVarSources(t *testing.T) {
+	dir := t.TempDir()
+	envPath := filepath.Join(dir, ".env")
+	if err := os.WriteFile(envPath, []byte("WATCHED=before\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	source, err := newVarSource(envPath, "", "")
+	if err != nil {
+		t.Fatalf("newVarSource failed: %v", err)
+	}
+
+	changed := make(chan struct{}, 1)
+	watchVarSources(source, 10*time.Millisecond, func() { changed <- struct{}{} })
+
+	if err := os.WriteFile(envPath, []byte("WATCHED=after change\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected change notification")
+	}
+	if value, _ := source.Lookup("WATCHED"); value != "after change" {
+		t.Errorf("Expected reloaded value, got %q", value)
+	}
+}
+
+func TestVarFilter(t *testing.T) {
+	filter, err := newVarFilter("PUBLIC_*,APP_NAME", "*_SECRET*")
+	if err != nil {
+		t.Fatalf("newVarFilter failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"PUBLIC_API_URL", true},
+		{"APP_NAME", true},
+		{"APP_NAME_EXTRA", false},
+		{"AWS_SECRET_ACCESS_KEY", false},
+		{"PUBLIC_SECRET_TOKEN", false},
+		{"HOME", false},
+	}
+	for _, tt := range tests {
+		if got := filter.allowed(tt.name); got != tt.want {
+			t.Errorf("allowed(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if !(varFilter{}).allowed("ANYTHING") {
+		t.Error("Expected empty filter to allow every name")
+	}
+	if _, err := newVarFilter("[", ""); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
+
+func TestReplaceEnvVarsHonorsVarFilter(t *testing.T) {
+	original := allowedVars
+	defer func() { allowedVars = original }()
+	allowedVars, _ = newVarFilter("PUBLIC_*", "")
+
+	os.Setenv("PUBLIC_URL", "https://example.com")
+	os.Setenv("PUBLIC_LEAK", "${PRIVATE_KEY}")
+	os.Setenv("PRIVATE_KEY", "secret")
+	defer os.Unsetenv("PUBLIC_URL")
+	defer os.Unsetenv("PUBLIC_LEAK")
+	defer os.Unsetenv("PRIVATE_KEY")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"${PUBLIC_URL}", "https://example.com"},
+		{"${PRIVATE_KEY}", "${PRIVATE_KEY}"},
+		{"${PRIVATE_KEY:=fallback}", "${PRIVATE_KEY:=fallback}"},
+		{"${PUBLIC_MISSING:=${PRIVATE_KEY}}", "${PRIVATE_KEY}"},
+		{"${PUBLIC_LEAK}", "${PRIVATE_KEY}"},
+	}
+	for _, tt := range tests {
+		if got := replaceEnvVars(tt.input); got != tt.expected {
+			t.Errorf("replaceEnvVars(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("${PUBLIC_URL} ${PRIVATE_KEY}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	err := checkEnvVarsInFiles(dir, "", "")
+	if err == nil || !strings.Contains(err.Error(), "PRIVATE_KEY (not allowed") || strings.Contains(err.Error(), "PUBLIC_URL") {
+		t.Errorf("Expected PRIVATE_KEY to be flagged as not allowed, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// escapers are selected with a modifier in the placeholder, e.g. ${TITLE|html}.
+var escapers = map[string]func(string) string{
+	"raw":  func(value string) string { return value },
+	"html": html.EscapeString,
+	"js":   template.JSEscapeString,
+	"json": escapeJSONString,
+	"url":  url.QueryEscape,
+}
+
+// extensionEscapers choose the escaper for placeholders without a modifier
+// when --env-auto-escape is enabled.
+var extensionEscapers = map[string]string{
+	".html": "html", ".htm": "html", ".xml": "html", ".svg": "html",
+	".js": "js", ".mjs": "js",
+	".json": "json",
+}
+
+// escapeJSONString escapes a value for use inside a JSON string literal. The
+// surrounding quotes are left to the template. <, > and & are escaped as
+// well, so the result is also safe inside an inline script.
+func escapeJSONString(value string) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded[1 : len(encoded)-1])
+}
+
+// defaultEscaper returns the escaper name for files of the given type, or an
+// empty string if values are inserted as-is.
+func defaultEscaper(name string) string {
+	return extensionEscapers[strings.ToLower(path.Ext(name))]
+}
+
+func escapeValue(value, escaper string) string {
+	if escape, ok := escapers[escaper]; ok {
+		return escape(value)
+	}
+	return value
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceEnvVarsEscapeModifiers(t *testing.T) {
+	os.Setenv("ESC_VALUE", `a"b</script><i>&'c`)
+	os.Setenv("ESC_QUERY", "a b&c=d")
+	defer os.Unsetenv("ESC_VALUE")
+	defer os.Unsetenv("ESC_QUERY")
+
+	tests := []struct {
+		input    string
+		expected string
+		desc     string
+	}{
+		{"${ESC_VALUE}", `a"b</script><i>&'c`, "no modifier inserts raw value"},
+		{"${ESC_VALUE|raw}", `a"b</script><i>&'c`, "raw modifier"},
+		{"${ESC_VALUE|html}", `a&#34;b&lt;/script&gt;&lt;i&gt;&amp;&#39;c`, "html modifier"},
+		{"${ESC_VALUE|js}", `a\"b\u003C/script\u003E\u003Ci\u003E\u0026\'c`, "js modifier"},
+		{"${ESC_VALUE|json}", `a\"b\u003c/script\u003e\u003ci\u003e\u0026'c`, "json modifier"},
+		{"${ESC_QUERY|url}", "a+b%26c%3Dd", "url modifier"},
+		{"${ESC_MISSING:=<b>|html}", "&lt;b&gt;", "default is escaped"},
+		{"${ESC_MISSING:=a|b}", "a|b", "pipe in default without known modifier"},
+		{"${ESC_MISSING|html}", "${ESC_MISSING|html}", "unresolved placeholder is left as-is"},
+		{"${ESC_VALUE|unknown}", "${ESC_VALUE|unknown}", "unknown modifier is not a placeholder"},
+	}
+
+	for _, test := range tests {
+		if got := replaceEnvVars(test.input); got != test.expected {
+			t.Errorf("%s: replaceEnvVars(%q) = %q, want %q", test.desc, test.input, got, test.expected)
+		}
+	}
+}
+
+func TestReplaceEnvVarsDefaultEscaper(t *testing.T) {
+	os.Setenv("ESC_VALUE", `<"x">`)
+	defer os.Unsetenv("ESC_VALUE")
+
+	if got := replaceEnvVarsEscaped("${ESC_VALUE}", "html"); got != "&lt;&#34;x&#34;&gt;" {
+		t.Errorf("Expected default escaper to apply, got %q", got)
+	}
+	if got := replaceEnvVarsEscaped("${ESC_VALUE|raw}", "html"); got != `<"x">` {
+		t.Errorf("Expected raw modifier to override default escaper, got %q", got)
+	}
+}
+
+func TestEnvFileSystemAutoEscape(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":  "<p>${ESC_VALUE}</p>",
+		"app.js":      `var x = "${ESC_VALUE}";`,
+		"config.json": `{"x": "${ESC_VALUE}"}`,
+		"style.css":   "/* ${ESC_VALUE} */",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	os.Setenv("ESC_VALUE", `"<>`)
+	defer os.Unsetenv("ESC_VALUE")
+
+	expected := map[string]string{
+		"index.html":  "<p>&#34;&lt;&gt;</p>",
+		"app.js":      `var x = "\"\u003C\u003E";`,
+		"config.json": `{"x": "\"\u003c\u003e"}`,
+		"style.css":   `/* "<> */`,
+	}
+
+	fs := EnvFileSystem{fs: http.Dir(dir), autoEscape: true}
+	for name, want := range expected {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open %s failed: %v", name, err)
+		}
+		b, _ := io.ReadAll(f)
+		f.Close()
+		if string(b) != want {
+			t.Errorf("%s: got %q, want %q", name, string(b), want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// newRenderedContent wraps substituted content with a strong ETag derived from
+// its bytes, so the tag changes whenever a variable value changes the output.
+func newRenderedContent(data []byte, substituted bool) *renderedContent {
+	sum := sha256.Sum256(data)
+	return &renderedContent{data: data, etag: `"` + hex.EncodeToString(sum[:16]) + `"`, substituted: substituted}
+}
+
+// fileHook is called with every file http.FileServer opens for a request and
+// returns the file to serve in its place.
+type fileHook func(w http.ResponseWriter, r *http.Request, name string, file http.File) http.File
+
+// fileServer serves fs with http.FileServer and runs hooks on every file it
+// opens. Hooks run before http.FileServer evaluates conditional requests, so
+// they can still set headers such as ETag without opening the file again.
+func fileServer(fs http.FileSystem, hooks ...fileHook) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		onOpen := func(name string, file http.File) http.File {
+			for _, hook := range hooks {
+				file = hook(w, r, name, file)
+			}
+			return file
+		}
+		http.FileServer(hookFileSystem{fs: fs, onOpen: onOpen}).ServeHTTP(w, r)
+	})
+}
+
+type hookFileSystem struct {
+	fs     http.FileSystem
+	onOpen func(name string, file http.File) http.File
+}
+
+func (h hookFileSystem) Open(name string) (http.File, error) {
+	file, err := h.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return h.onOpen(name, file), nil
+}
+
+// setETag sets the ETag of substituted files. http.FileServer then answers
+// If-None-Match and If-Match against it, and prefers it over Last-Modified.
+func setETag(w http.ResponseWriter, r *http.Request, name string, file http.File) http.File {
+	if envFile, ok := file.(*EnvFile); ok && envFile.etag != "" {
+		w.Header().Set("ETag", envFile.etag)
+	}
+	return file
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestETagHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>${ETAG_VAR}</p>"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "logo.png"), []byte("png"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	os.Setenv("ETAG_VAR", "first")
+	defer os.Unsetenv("ETAG_VAR")
+
+	envFS := EnvFileSystem{fs: http.Dir(dir), cache: newContentCache(1024)}
+	handler := fileServer(envFS, setETag)
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get("/", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with ETag, got %d and %q", first.Code, etag)
+	}
+	if etag[0] != '"' || etag[len(etag)-1] != '"' {
+		t.Errorf("Expected strong ETag, got %q", etag)
+	}
+	if other := get("/index.html", "").Header().Get("ETag"); other != "" {
+		t.Errorf("Expected no ETag on the redirect for /index.html, got %q", other)
+	}
+
+	if rec := get("/", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for matching If-None-Match, got %d", rec.Code)
+	}
+
+	os.Setenv("ETAG_VAR", "second")
+	envFS.cache.purge()
+	changed := get("/", etag)
+	if changed.Code != http.StatusOK || changed.Body.String() != "<p>second</p>" {
+		t.Errorf("Expected 200 with new content after the value changed, got %d %q", changed.Code, changed.Body.String())
+	}
+	if changed.Header().Get("ETag") == etag {
+		t.Error("Expected ETag to change with the substituted content")
+	}
+
+	if rec := get("/logo.png", ""); rec.Header().Get("ETag") != "" {
+		t.Errorf("Expected no ETag for files served from disk, got %q", rec.Header().Get("ETag"))
+	}
+}
+
+// countingFileSystem counts how often each name is opened.
+type countingFileSystem struct {
+	fs     http.FileSystem
+	mu     sync.Mutex
+	opened map[string]int
+}
+
+func (c *countingFileSystem) Open(name string) (http.File, error) {
+	c.mu.Lock()
+	c.opened[name]++
+	c.mu.Unlock()
+	return c.fs.Open(name)
+}
+
+func TestFileServerOpensOnce(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "page.html"), []byte("<p>${ETAG_ONCE:=x}</p>"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	counter := &countingFileSystem{fs: http.Dir(dir), opened: make(map[string]int)}
+	envFS := EnvFileSystem{fs: counter}
+	handler := fileServer(envFS, setETag)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page.html", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == "" {
+		t.Fatalf("Expected 200 with ETag, got %d and %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if n := counter.opened["/page.html"]; n != 1 {
+		t.Errorf("Expected the file to be opened once, got %d", n)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/page.html", nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for matching If-None-Match, got %d", rec.Code)
+	}
+}
+
+func TestEnvFileModTimeFollowsVariables(t *testing.T) {
+	dir := t.TempDir()
+	testFile := filepath.Join(dir, "test.txt")
+	if err := os.WriteFile(testFile, []byte("${MODTIME_VAR}"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(testFile, old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	os.Setenv("MODTIME_VAR", "value")
+	defer os.Unsetenv("MODTIME_VAR")
+	previous := varsChangedAt.Load()
+	defer varsChangedAt.Store(previous)
+	varsChangedAt.Store(0)
+
+	envFS := EnvFileSystem{fs: http.Dir(dir)}
+	modTime := func() time.Time {
+		f, err := envFS.Open("/test.txt")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		return stat.ModTime()
+	}
+
+	if got := modTime(); !got.Equal(old) {
+		t.Errorf("Expected file modification time %v, got %v", old, got)
+	}
+	markVarsChanged()
+	if got := modTime(); !got.After(old) {
+		t.Errorf("Expected modification time to follow the variable change, got %v", got)
+	}
+
+	plainFile := filepath.Join(dir, "plain.txt")
+	if err := os.WriteFile(plainFile, []byte("no placeholders"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Chtimes(plainFile, old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	f, err := envFS.Open("/plain.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	if stat, _ := f.Stat(); !stat.ModTime().Equal(old) {
+		t.Errorf("Expected unsubstituted file to keep its modification time %v, got %v", old, stat.ModTime())
+	}
+}
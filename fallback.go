@@ -11,24 +11,52 @@ type fallback struct {
 	fs          http.FileSystem
 }
 
+// resolvingFileSystem is implemented by file systems that may open a different
+// file than the one requested. openResolved returns the name of the file it
+// actually opened.
+type resolvingFileSystem interface {
+	openResolved(name string) (http.File, string, error)
+}
+
+// openResolved opens name from fs and returns the name of the file behind it,
+// which differs from name when fs is a fallback.
+func openResolved(fs http.FileSystem, name string) (http.File, string, error) {
+	if r, ok := fs.(resolvingFileSystem); ok {
+		return r.openResolved(name)
+	}
+	file, err := fs.Open(name)
+	return file, name, err
+}
+
 func OpenDefault(fb fallback, requestPath string) (http.File, error) {
+	f, _, err := openDefault(fb, requestPath)
+	return f, err
+}
+
+func openDefault(fb fallback, requestPath string) (http.File, string, error) {
 	requestPath = path.Dir(requestPath)
 	defaultFile := requestPath + "/" + fb.defaultPath
 	f, err := fb.fs.Open(defaultFile)
 	if os.IsNotExist(err) && requestPath != "" {
 		parentPath, _ := path.Split(requestPath)
-		return OpenDefault(fb, parentPath)
+		return openDefault(fb, parentPath)
 	}
-	return f, err
+	return f, path.Clean(defaultFile), err
 }
 
 func (fb fallback) Open(requestPath string) (http.File, error) {
+	f, _, err := fb.openResolved(requestPath)
+	return f, err
+}
+
+func (fb fallback) openResolved(requestPath string) (http.File, string, error) {
 	f, err := fb.fs.Open(requestPath)
 	if os.IsNotExist(err) {
 		if len(fb.defaultPath) == 0 || fb.defaultPath[0] == '/' {
-			return fb.fs.Open(fb.defaultPath)
+			f, err = fb.fs.Open(fb.defaultPath)
+			return f, fb.defaultPath, err
 		}
-		return OpenDefault(fb, requestPath)
+		return openDefault(fb, requestPath)
 	}
-	return f, err
+	return f, requestPath, err
 }
@@ -2,4 +2,10 @@ module github.com/mallocator/goStaticEnv
 
 go 1.24
 
-require github.com/rs/zerolog v1.26.1
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
+	github.com/rs/zerolog v1.26.1
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func stringListFlag(name, usage string) *stringList {
+	list := &stringList{}
+	flag.Var(list, name, usage)
+	return list
+}
+
+// parseHeaderFlags turns HeaderName:Value pairs into a header. Entries without
+// a name or value are logged and skipped.
+func parseHeaderFlags(values []string) http.Header {
+	header := make(http.Header)
+	for _, value := range values {
+		name, headerValue := parseHeaderFlag(value)
+		name, headerValue = strings.TrimSpace(name), strings.TrimSpace(headerValue)
+		if len(name) == 0 || len(headerValue) == 0 {
+			log.Warn().Str("header", value).Msg("appendHeader misconfigured; ignoring.")
+			continue
+		}
+		header.Add(name, headerValue)
+	}
+	return header
+}
+
+// responseHeadersHandler sets and removes response headers right before the
+// status is written, so it also applies to headers added by h and its
+// middlewares. Set headers replace any existing values. Removing Content-Type
+// also stops net/http from sniffing one.
+func responseHeadersHandler(h http.Handler, set http.Header, remove []string) http.Handler {
+	return beforeWriteHeader(h, func(w http.ResponseWriter, r *http.Request, status int) {
+		header := w.Header()
+		for _, name := range remove {
+			removeHeader(header, name)
+		}
+		for name, values := range set {
+			header[name] = values
+		}
+	})
+}
+
+// removeHeader deletes a response header. Content-Type is kept as an empty
+// entry instead, which stops net/http from sniffing one.
+func removeHeader(header http.Header, name string) {
+	if http.CanonicalHeaderKey(name) == "Content-Type" {
+		header["Content-Type"] = nil
+		return
+	}
+	header.Del(name)
+}
+
+// beforeWriteHeader calls apply once per response, right before the status is
+// written, or after h returns if it wrote nothing.
+func beforeWriteHeader(h http.Handler, apply func(w http.ResponseWriter, r *http.Request, status int)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerResponseWriter{ResponseWriter: w}
+		hw.apply = func(status int) { apply(w, r, status) }
+		h.ServeHTTP(hw, r)
+		if !hw.wroteHeader {
+			hw.wroteHeader = true
+			hw.apply(http.StatusOK)
+		}
+	})
+}
+
+type headerResponseWriter struct {
+	http.ResponseWriter
+	apply       func(status int)
+	wroteHeader bool
+}
+
+func (w *headerResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.apply(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile working through the wrapper.
+func (w *headerResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *headerResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *headerResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *headerResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
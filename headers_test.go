@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStringListFlag(t *testing.T) {
+	var list stringList
+	for _, value := range []string{"X-Frame-Options:DENY", "Content-Security-Policy:default-src 'self', img-src *"} {
+		if err := list.Set(value); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	if len(list) != 2 || list[1] != "Content-Security-Policy:default-src 'self', img-src *" {
+		t.Errorf("Expected both values to be kept as given, got %v", list)
+	}
+}
+
+func TestParseHeaderFlags(t *testing.T) {
+	header := parseHeaderFlags([]string{
+		"X-Frame-Options: DENY",
+		"Strict-Transport-Security:max-age=31536000",
+		"x-custom:a",
+		"X-Custom:b",
+		"X-Empty:",
+		"NoValue",
+	})
+	if got := header.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("Expected trimmed value DENY, got %q", got)
+	}
+	if got := header.Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("Unexpected HSTS value %q", got)
+	}
+	if got := header.Values("X-Custom"); len(got) != 2 {
+		t.Errorf("Expected repeated header to keep both values, got %v", got)
+	}
+	if _, ok := header["X-Empty"]; ok {
+		t.Error("Expected header without value to be skipped")
+	}
+	if len(header) != 3 {
+		t.Errorf("Expected 3 headers, got %v", header)
+	}
+}
+
+func TestResponseHeadersHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>hello</p>"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	set := parseHeaderFlags([]string{"X-Frame-Options:DENY", "Cache-Control:no-store"})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream")
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+	})
+	handler := responseHeadersHandler(upstream, set, []string{"server", "Content-Type"})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "<p>hello</p>" {
+		t.Fatalf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("Expected X-Frame-Options DENY, got %q", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Expected flag to replace upstream Cache-Control, got %q", got)
+	}
+	if got := rec.Header().Get("Server"); got != "" {
+		t.Errorf("Expected Server header to be removed, got %q", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "" {
+		t.Errorf("Expected Content-Type to be removed, got %q", got)
+	}
+
+	// Headers are applied to responses that write neither status nor body
+	empty := responseHeadersHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), set, nil)
+	rec = httptest.NewRecorder()
+	empty.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("Expected headers on empty response, got %q", got)
+	}
+}
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -20,8 +19,13 @@ var (
 	context                  = flag.String("context", "", "The 'context' path on which files are served, e.g. 'doc' will serve the files at 'http://localhost:<port>/doc/'")
 	basePath                 = flag.String("path", "/srv/http", "The path for the static files")
 	vhostPrefix              = flag.String("vhost", "", "The prefix for locating lightweight virtual hosted subdomains, or vhosts. E.g. 'labs' will serve the files at /srv/http/labs/tango when someone visits http://tango.your.tld")
+	vhostDomain              = flag.String("vhost-domain", "", "Comma-separated list of domains whose subdomains are vhosts, e.g. 'example.com' serves app.staging.example.com from the 'app.staging' vhost directory")
+	vhostWildcards           = flag.String("vhost-wildcard", "", "Comma-separated list of wildcard hosts mapped to a directory of vhosts, e.g. '*.preview.example.com=previews' serves feature-x.preview.example.com from previews/feature-x")
+	vhostConfigPath          = flag.String("vhost-config", "", "Path to a JSON, YAML or TOML file mapping hostnames to document roots, each with optional fallback, context, headers and auth")
+	vhostWatchInterval       = flag.Duration("vhost-watch-interval", 10*time.Second, "How often to check the vhost directories for added or removed vhosts. 0 disables rescanning")
 	fallbackPath             = flag.String("fallback", "", "Default fallback file. Either absolute for a specific asset (/index.html), or relative to recursively resolve (index.html)")
-	headerFlag               = flag.String("append-header", "", "HTTP response header, specified as `HeaderName:Value` that should be added to all responses.")
+	appendHeaders            = stringListFlag("append-header", "HTTP response header, specified as `HeaderName:Value` that should be added to all responses. Can be given multiple times")
+	removeHeaders            = stringListFlag("remove-header", "Name of an HTTP response `header` to remove from all responses, e.g. Content-Type to disable type sniffing. Can be given multiple times")
 	basicAuth                = flag.Bool("enable-basic-auth", false, "Enable basic auth. By default, password are randomly generated. Use --set-basic-auth to set it.")
 	healthCheck              = flag.Bool("enable-health", false, "Enable health check endpoint. You can call /health to get a 200 response. Useful for Kubernetes, OpenFaas, etc.")
 	setBasicAuth             = flag.String("set-basic-auth", "", "Define the basic auth. Form must be user:password")
@@ -30,12 +34,29 @@ var (
 	logLevel                 = flag.String("log-level", "info", "default: info - What level of logging to run, debug logs all requests (error, warn, info, debug)")
 	logRequest               = flag.Bool("enable-logging", false, "Enable log request. NOTE: Deprecated, set log-level to debug to log all requests")
 	httpsPromote             = flag.Bool("https-promote", false, "All HTTP requests should be redirected to HTTPS")
-	headerConfigPath         = flag.String("header-config-path", "/config/headerConfig.json", "Path to the config file for custom response headers")
+	headerConfigPath         = flag.String("header-config-path", "/config/headerConfig.json", "Path to the JSON, YAML or TOML config file for custom response headers")
+	headerConfigWatch        = flag.Duration("header-config-watch-interval", 10*time.Second, "How often to check the header config file for changes and reload it. 0 disables reloading")
 	basicAuthUser            = flag.String("basic-auth-user", "", "Username for basic auth")
 	basicAuthPass            = flag.String("basic-auth-pass", "", "Password for basic auth")
 	allowMissingEnv          = flag.Bool("allow-missing-env", false, "Allow server to start with warnings when environment variables are missing, instead of exiting with fatal error")
-	envInclude               = flag.String("env-include", "", "Comma-separated list of directories and files to include when scanning for environment variables (relative to base path)")
-	envExclude               = flag.String("env-exclude", "", "Comma-separated list of directories and files to exclude when scanning for environment variables (relative to base path)")
+	envInclude               = flag.String("env-include", "", "Comma-separated list of directories and files to include when scanning and substituting environment variables (relative to base path)")
+	envExclude               = flag.String("env-exclude", "", "Comma-separated list of directories and files to exclude when scanning and substituting environment variables (relative to base path)")
+	envCacheSize             = flag.Int("env-cache-size", 64, "Maximum memory in MB used to cache files after environment variable substitution, 0 disables the cache")
+	envMaxSize               = flag.Int("env-max-size", 10, "Files larger than this size in MB are streamed without environment variable substitution, 0 disables the limit")
+	envFile                  = flag.String("env-file", "", "Comma-separated list of dotenv files to read variables from")
+	envValuesFile            = flag.String("env-values-file", "", "Comma-separated list of JSON or YAML files with flat key-value pairs to read variables from")
+	envSecretsDir            = flag.String("env-secrets-dir", "", "Comma-separated list of directories with one file per variable, named after the variable, e.g. a mounted Kubernetes secret")
+	envWatchInterval         = flag.Duration("env-watch-interval", 0, "How often to check variable files and directories for changes and reload them, e.g. '10s'. 0 disables reloading")
+	envAutoEscape            = flag.Bool("env-auto-escape", false, "Escape substituted values without a modifier based on the file type: HTML for .html, .htm, .xml and .svg, JavaScript strings for .js and .mjs, JSON strings for .json")
+	envAllow                 = flag.String("env-allow", "", "Comma-separated list of variable names or glob patterns, e.g. 'PUBLIC_*,APP_*', that placeholders may expand. Empty allows all variables")
+	envDeny                  = flag.String("env-deny", "", "Comma-separated list of variable names or glob patterns that placeholders may never expand, e.g. 'AWS_*,*_SECRET*'")
+	envReportMode            = flag.Bool("env-report", false, "Scan the static files, print a JSON report of all placeholders to stdout and exit. Exits with status 1 if variables are missing, unless allow-missing-env is set")
+	disableEnvSubst          = flag.Bool("disable-env-substitution", false, "Serve files as they are on disk without substituting environment variables, e.g. for a tree prepared with the render command")
+	renderOut                = flag.String("render-out", "", "render: Directory to write the substituted files to")
+	renderInPlace            = flag.Bool("render-in-place", false, "render: Overwrite the substituted files in the static files path")
+	renderPrecompress        = flag.Bool("render-precompress", true, "render: Also write .gz and .br versions of compressible files")
+	disableCompression       = flag.Bool("disable-compression", false, "Disable compressing responses with gzip, brotli or zstd based on the Accept-Encoding request header")
+	validateConfig           = flag.Bool("validate-config", false, "Check the header config file, and the vhost config file if set, for errors and exit. Exits with status 1 if one is missing or invalid")
 
 	username string
 	password string
@@ -67,27 +88,6 @@ func parseHeaderFlag(headerFlag string) (string, string) {
 	return pieces[0], pieces[1]
 }
 
-var gzPool = sync.Pool{
-	New: func() interface{} {
-		w := gzip.NewWriter(io.Discard)
-		return w
-	},
-}
-
-type gzipResponseWriter struct {
-	io.Writer
-	http.ResponseWriter
-}
-
-func (w *gzipResponseWriter) WriteHeader(status int) {
-	w.Header().Del("Content-Length")
-	w.ResponseWriter.WriteHeader(status)
-}
-
-func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
-}
-
 func handleReq(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if *httpsPromote && r.Header.Get("X-Forwarded-Proto") == "http" {
@@ -103,6 +103,10 @@ func handleReq(h http.Handler) http.Handler {
 
 func main() {
 	flag.Parse()
+	renderMode := flag.Arg(0) == "render"
+	if renderMode {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
@@ -120,12 +124,122 @@ func main() {
 	setupLogger(*logLevel)
 	log.Debug().Str("Logging Level", zerolog.GlobalLevel().String()).Msg("Logger setup...")
 
+	if *validateConfig {
+		if _, err := loadHeaderConfig(*headerConfigPath); err != nil {
+			log.Fatal().Err(err).Msg("Invalid header config")
+		}
+		log.Info().Str("path", *headerConfigPath).Msg("Header config is valid")
+		if *vhostConfigPath != "" {
+			if _, err := loadVhostConfig(*vhostConfigPath); err != nil {
+				log.Fatal().Err(err).Msg("Invalid vhost config")
+			}
+			log.Info().Str("path", *vhostConfigPath).Msg("Vhost config is valid")
+		}
+		os.Exit(0)
+	}
+
 	if len(*setBasicAuth) != 0 && !*basicAuth {
 		log.Debug().Msg("Basic Auth Set")
 		*basicAuth = true
 	}
 
-	if err := checkEnvVarsInFiles(*basePath, *envInclude, *envExclude); err != nil {
+	filter, err := newVarFilter(*envAllow, *envDeny)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid variable name patterns")
+	}
+	allowedVars = filter
+
+	source, err := newVarSource(*envFile, *envValuesFile, *envSecretsDir)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load variable sources")
+	}
+	varSource = source
+	markVarsChanged()
+	contentCache := newContentCache(int64(*envCacheSize) << 20)
+	if *envWatchInterval > 0 {
+		watchVarSources(source, *envWatchInterval, contentCache.purge)
+	}
+
+	envSubstitution := renderMode || !*disableEnvSubst
+	headerConfigValid := false
+	if !renderMode {
+		if headerConfigValid, err = initHeaderConfig(*headerConfigPath); err != nil {
+			log.Fatal().Err(err).Msg("Invalid header config")
+		}
+	}
+
+	envFileSystem := EnvFileSystem{
+		fs:         http.Dir(*basePath),
+		cache:      contentCache,
+		maxSize:    int64(*envMaxSize) << 20,
+		filter:     newEnvFilter(*envInclude, *envExclude),
+		autoEscape: *envAutoEscape,
+	}
+	var siteEnvFS *EnvFileSystem
+	if envSubstitution {
+		siteEnvFS = &envFileSystem
+	}
+
+	var headerSources []headerSource
+	if headerConfigValid {
+		headerSources = append(headerSources, headerSource{"header config", *headerConfigPath, headerConfigs.Load().definitions()})
+	}
+
+	envRoots := []string{*basePath}
+	var vhosts *vhostTable
+	var sites vhostSites
+	if !renderMode {
+		resolver, err := newVhostResolver(*vhostDomain, *vhostWildcards)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid vhost configuration")
+		}
+		newSite := newSiteBuilder(siteEnvFS)
+		if *vhostConfigPath != "" {
+			configs, err := loadVhostConfig(*vhostConfigPath)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid vhost config")
+			}
+			if sites, err = newVhostSites(configs, newSite); err != nil {
+				log.Fatal().Err(err).Msg("Invalid vhost config")
+			}
+			log.Info().Str("path", *vhostConfigPath).Int("vhosts", len(configs.Vhosts)).Msg("Loaded vhost config")
+			headerSources = append(headerSources, headerSource{"vhost config", *vhostConfigPath, configs.definitions()})
+		}
+		if vhosts, err = newVhostTable(http.Dir(*basePath), resolver, newSite); err != nil {
+			log.Fatal().Err(err).Msg("Failed to detect vhosts")
+		}
+		// Vhost directories inside the static files path are covered by its scan
+		for _, root := range sites.roots {
+			if _, inside := relativeToBasePath(root); !inside {
+				envRoots = append(envRoots, root)
+			}
+		}
+	}
+
+	if *envReportMode {
+		// Report on exactly what the startup check below enforces
+		var reportRoots []string
+		if envSubstitution {
+			reportRoots = envRoots
+		}
+		if err := writeEnvReport(os.Stdout, reportRoots, *envInclude, *envExclude, headerSources, *allowMissingEnv); err != nil {
+			log.Fatal().Err(err).Msg("Environment report failed")
+		}
+		os.Exit(0)
+	}
+
+	var missingVars []error
+	if !envSubstitution {
+		log.Info().Msg("Environment variable substitution disabled")
+	} else if err := checkEnvVarsInRoots(envRoots, *envInclude, *envExclude); err != nil {
+		missingVars = append(missingVars, err)
+	}
+	for _, source := range headerSources {
+		if err := checkEnvVarsInHeaders(source.name, source.headers); err != nil {
+			missingVars = append(missingVars, err)
+		}
+	}
+	if err := errors.Join(missingVars...); err != nil {
 		if *allowMissingEnv {
 			log.Warn().Err(err).Msg("Missing required environment variables, starting with warnings")
 		} else {
@@ -134,21 +248,22 @@ func main() {
 		}
 	}
 
+	if renderMode {
+		runRender(envFileSystem)
+		return
+	}
+
 	port := ":" + strconv.FormatInt(int64(*portPtr), 10)
-	var fileSystem http.FileSystem = http.Dir(*basePath)
 	log.Debug().Str("path", *basePath).Msg("File serve path set")
-
 	if *fallbackPath != "" {
 		log.Debug().Str("FallbackPath", *fallbackPath).Msg("Fallback path set")
-		fileSystem = fallback{
-			defaultPath: *fallbackPath,
-			fs:          fileSystem,
-		}
 	}
-	fileSystem = EnvFileSystem{fs: fileSystem}
 
-	handler := handleReq(http.FileServer(fileSystem))
-	handler = vhostify(handler, fileSystem)
+	handler := siteHandler(siteFileSystem("", *basePath, *fallbackPath, siteEnvFS), *basePath)
+	if *vhostWatchInterval > 0 {
+		vhosts.watch(*vhostWatchInterval)
+	}
+	handler = vhostify(handler, vhosts, sites)
 
 	pathPrefix := "/"
 	if len(*context) > 0 {
@@ -168,32 +283,21 @@ func main() {
 		handler = authMiddleware(handler)
 	}
 
-	headerConfigValid := initHeaderConfig(*headerConfigPath)
-	if headerConfigValid {
+	if *headerConfigWatch > 0 {
+		watchHeaderConfig(*headerConfigPath, *headerConfigWatch)
+	}
+	if headerConfigValid || *headerConfigWatch > 0 {
 		handler = customHeadersMiddleware(handler)
 	}
 
-	if len(*headerFlag) > 0 {
-		header, headerValue := parseHeaderFlag(*headerFlag)
-		if len(header) > 0 && len(headerValue) > 0 {
-			fileServer := handler
-			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				log.Debug().Str("URL", r.URL.Path).Str("header", header).Str("headerValue", headerValue).Msg("Extra Headers Handled")
-				w.Header().Set(header, headerValue)
-				if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-					fileServer.ServeHTTP(w, r)
-				} else {
-					w.Header().Set("Content-Encoding", "gzip")
-					gz := gzPool.Get().(*gzip.Writer)
-					defer gzPool.Put(gz)
-					gz.Reset(w)
-					defer gz.Close()
-					fileServer.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, Writer: gz}, r)
-				}
-			})
-		} else {
-			log.Warn().Msg("appendHeader misconfigured; ignoring.")
-		}
+	if !*disableCompression {
+		handler = compressHandler(handler)
+	}
+
+	if len(*appendHeaders) > 0 || len(*removeHeaders) > 0 {
+		extraHeaders := parseHeaderFlags(*appendHeaders)
+		log.Debug().Interface("set", extraHeaders).Strs("remove", *removeHeaders).Msg("Extra Headers Configured")
+		handler = responseHeadersHandler(handler, extraHeaders, *removeHeaders)
 	}
 
 	if *healthCheck {
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+
+	"github.com/rs/zerolog/log"
+)
+
+// precompressedExtensions maps encodings to the file extension of their
+// precompressed siblings, e.g. app.js.br next to app.js.
+var precompressedExtensions = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// precompressedSibling returns a hook that serves a precompressed sibling from
+// raw in place of the opened file when the client accepts its encoding.
+// Siblings are only used for the file that was requested, never for one the
+// fallback answered with. Files that substitution changed are kept, since
+// their siblings hold the unsubstituted bytes.
+func precompressedSibling(raw http.FileSystem) fileHook {
+	return func(w http.ResponseWriter, r *http.Request, name string, file http.File) http.File {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Range") != "" {
+			return file
+		}
+		if envFile, ok := file.(*EnvFile); ok && envFile.substituted {
+			return file
+		}
+		stat, err := file.Stat()
+		if err != nil || !stat.Mode().IsRegular() || stat.Name() != path.Base(name) {
+			return file
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			return file
+		}
+
+		for _, encoding := range acceptedEncodings(r.Header.Get("Accept-Encoding")) {
+			sibling, err := raw.Open(name + precompressedExtensions[encoding])
+			if err != nil {
+				continue
+			}
+			if stat, err := sibling.Stat(); err != nil || !stat.Mode().IsRegular() {
+				sibling.Close()
+				continue
+			}
+
+			header := w.Header()
+			header.Set("Content-Type", contentType)
+			header.Set("Content-Encoding", encoding)
+			addVaryAcceptEncoding(header)
+			weakenETag(header)
+			log.Debug().Str("Path", name).Str("encoding", encoding).Msg("Serving precompressed file")
+			file.Close()
+			return sibling
+		}
+		return file
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrecompressedHandler(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.js":         strings.Repeat("console.log('app');\n", 100),
+		"app.js.br":      "brotli bytes",
+		"app.js.gz":      "gzip bytes",
+		"app.js.zst":     "zstd bytes",
+		"config.js":      "const api = '${PRECOMP_API}';\n" + strings.Repeat("// filler\n", 200),
+		"config.js.gz":   "stale gzip bytes",
+		"index.html":     "<p>index</p>",
+		"index.html.gz":  "index gzip bytes",
+		"only-gz.css":    "body {}",
+		"only-gz.css.gz": "css gzip bytes",
+		"ghost.js.gz":    "orphaned gzip bytes",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	os.Setenv("PRECOMP_API", "https://api.example.com")
+	defer os.Unsetenv("PRECOMP_API")
+
+	counter := &countingFileSystem{fs: http.Dir(dir), opened: make(map[string]int)}
+	var envFS http.FileSystem = EnvFileSystem{fs: fallback{defaultPath: "/index.html", fs: counter}}
+	handler := compressHandler(fileServer(envFS, setETag, precompressedSibling(http.Dir(dir))))
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"/app.js", "gzip, br", "br", "brotli bytes"},
+		{"/app.js", "gzip, zstd", "zstd", "zstd bytes"},
+		{"/app.js", "br;q=0.5, gzip", "gzip", "gzip bytes"},
+		{"/", "gzip", "gzip", "index gzip bytes"},
+		{"/only-gz.css", "br, gzip", "gzip", "css gzip bytes"},
+	}
+	for _, test := range tests {
+		rec := get(test.path, test.acceptEncoding)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != test.encoding || rec.Body.String() != test.body {
+			t.Errorf("%s with %q: expected %s sibling, got %d %q %q", test.path, test.acceptEncoding, test.encoding, rec.Code, rec.Header().Get("Content-Encoding"), rec.Body.String())
+			continue
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: expected Vary: Accept-Encoding, got %q", test.path, rec.Header().Get("Vary"))
+		}
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), mimeTypeFor(test.path)) {
+			t.Errorf("%s: expected content type of the original file, got %q", test.path, rec.Header().Get("Content-Type"))
+		}
+	}
+
+	delete(counter.opened, "/app.js")
+	if rec := get("/app.js", "br"); !strings.HasPrefix(rec.Header().Get("ETag"), "W/") {
+		t.Errorf("Expected weak ETag for precompressed sibling, got %q", rec.Header().Get("ETag"))
+	}
+	if n := counter.opened["/app.js"]; n != 1 {
+		t.Errorf("Expected the original file to be opened once, got %d", n)
+	}
+
+	if rec := get("/app.js", ""); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != files["app.js"] {
+		t.Error("Expected original file without Accept-Encoding")
+	}
+
+	// Substituted files are compressed live instead of using the stale sibling
+	rec := get("/config.js", "gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" || strings.Contains(rec.Body.String(), "stale") {
+		t.Errorf("Expected live compression for substituted file, got %q", rec.Body.String())
+	}
+
+	// The fallback must not answer for missing siblings
+	if rec := get("/missing.js", "gzip"); rec.Body.String() != "<p>index</p>" {
+		t.Errorf("Expected fallback content for missing file, got %q", rec.Body.String())
+	}
+	if rec := get("/ghost.js", "gzip"); rec.Body.String() != "<p>index</p>" {
+		t.Errorf("Expected fallback content instead of a sibling without original, got %q", rec.Body.String())
+	}
+}
+
+func mimeTypeFor(path string) string {
+	switch filepath.Ext(path) {
+	case ".js":
+		return "text/javascript"
+	case ".css":
+		return "text/css"
+	}
+	return "text/html"
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/rs/zerolog/log"
+)
+
+// precompressMinSize is the smallest file that gets precompressed siblings.
+// Below it the compressed form is rarely worth the extra request handling.
+const precompressMinSize = 1024
+
+// renderTree writes every file below src to dst after running it through
+// envFS, so the output matches what the server would send. If dst is empty or
+// the same as src, only files that substitution changed are rewritten in place
+// and all other files are left alone. With precompress, compressible files also get .gz and .br
+// siblings.
+func renderTree(envFS EnvFileSystem, src, dst string, precompress bool) error {
+	src = filepath.Clean(src)
+	inPlace := dst == "" || filepath.Clean(dst) == src
+	if !inPlace {
+		dst = filepath.Clean(dst)
+	}
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && !inPlace && path == dst {
+			return filepath.SkipDir
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := path
+		if !inPlace {
+			target = filepath.Join(dst, relPath)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		data, substituted, err := renderFile(envFS, "/"+filepath.ToSlash(relPath))
+		if err != nil {
+			return err
+		}
+		if substituted || !inPlace {
+			if err := os.WriteFile(target, data, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to write %s: %w", target, err)
+			}
+			log.Debug().Str("file", target).Bool("substituted", substituted).Msg("Rendered file")
+		}
+
+		if precompress && len(data) >= precompressMinSize && !isBinaryFile(path) {
+			return writePrecompressed(target, data, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// renderFile returns the content of name as served by envFS and whether
+// substitution changed it.
+func renderFile(envFS EnvFileSystem, name string) ([]byte, bool, error) {
+	file, err := envFS.Open(name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	envFile, ok := file.(*EnvFile)
+	return data, ok && envFile.substituted, nil
+}
+
+// writePrecompressed writes path.gz and path.br next to path.
+func writePrecompressed(path string, data []byte, perm os.FileMode) error {
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		".gz": func(w io.Writer) io.WriteCloser {
+			gz, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+			return gz
+		},
+		".br": func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, brotli.BestCompression)
+		},
+	}
+
+	for ext, newEncoder := range encoders {
+		var buf bytes.Buffer
+		encoder := newEncoder(&buf)
+		if _, err := encoder.Write(data); err != nil {
+			return fmt.Errorf("failed to compress %s: %w", path, err)
+		}
+		if err := encoder.Close(); err != nil {
+			return fmt.Errorf("failed to compress %s: %w", path, err)
+		}
+		if err := os.WriteFile(path+ext, buf.Bytes(), perm); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path+ext, err)
+		}
+	}
+	return nil
+}
+
+// runRender implements the render subcommand, reusing the server flags for
+// the source path, variable sources and include/exclude rules.
+func runRender(envFS EnvFileSystem) {
+	if *renderOut == "" && !*renderInPlace {
+		log.Fatal().Msg("render needs --render-out or --render-in-place")
+	}
+	if *renderOut != "" && *renderInPlace {
+		log.Fatal().Msg("render takes either --render-out or --render-in-place, not both")
+	}
+	if abs, err := filepath.Abs(*renderOut); *renderOut != "" && err == nil {
+		if src, err := filepath.Abs(*basePath); err == nil && strings.HasPrefix(src+string(filepath.Separator), abs+string(filepath.Separator)) {
+			log.Fatal().Str("out", *renderOut).Msg("render output directory can't contain the source path")
+		}
+	}
+
+	if err := renderTree(envFS, *basePath, *renderOut, *renderPrecompress); err != nil {
+		log.Fatal().Err(err).Msg("Render failed")
+	}
+	log.Info().Str("path", *basePath).Str("out", *renderOut).Msg("Rendered static files")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func writeRenderFixture(t *testing.T, dir string) {
+	t.Helper()
+	files := map[string]string{
+		"index.html":     "<title>${RENDER_TITLE}</title>",
+		"big.js":         "const title = \"${RENDER_TITLE}\";\n" + strings.Repeat("// filler\n", 200),
+		"plain.txt":      "no placeholders",
+		"skip/config.js": "${RENDER_TITLE}",
+		"image.png":      "${RENDER_TITLE}" + strings.Repeat("x", 2000),
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	return string(data)
+}
+
+func TestRenderTreeOutDir(t *testing.T) {
+	src := t.TempDir()
+	out := filepath.Join(t.TempDir(), "out")
+	writeRenderFixture(t, src)
+
+	os.Setenv("RENDER_TITLE", "Rendered")
+	defer os.Unsetenv("RENDER_TITLE")
+
+	envFS := EnvFileSystem{fs: http.Dir(src), filter: newEnvFilter("", "skip")}
+	if err := renderTree(envFS, src, out, true); err != nil {
+		t.Fatalf("renderTree failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"index.html":     "<title>Rendered</title>",
+		"plain.txt":      "no placeholders",
+		"skip/config.js": "${RENDER_TITLE}",
+	}
+	for name, want := range expected {
+		if got := readFile(t, filepath.Join(out, name)); got != want {
+			t.Errorf("Expected %s to be %q, got %q", name, want, got)
+		}
+	}
+	if got := readFile(t, filepath.Join(out, "image.png")); !strings.HasPrefix(got, "${RENDER_TITLE}") {
+		t.Errorf("Expected binary file to be copied untouched, got %q", got[:20])
+	}
+
+	bigJS := readFile(t, filepath.Join(out, "big.js"))
+	if !strings.HasPrefix(bigJS, "const title = \"Rendered\";") {
+		t.Errorf("Expected big.js to be substituted, got %q", bigJS[:30])
+	}
+
+	gz, err := os.Open(filepath.Join(out, "big.js.gz"))
+	if err != nil {
+		t.Fatalf("Expected gzip sibling: %v", err)
+	}
+	defer gz.Close()
+	gzReader, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatalf("gzip.NewReader failed: %v", err)
+	}
+	if data, _ := io.ReadAll(gzReader); string(data) != bigJS {
+		t.Error("Expected gzip sibling to contain the rendered content")
+	}
+
+	br := readFile(t, filepath.Join(out, "big.js.br"))
+	if data, _ := io.ReadAll(brotli.NewReader(bytes.NewReader([]byte(br)))); string(data) != bigJS {
+		t.Error("Expected brotli sibling to contain the rendered content")
+	}
+
+	for _, name := range []string{"index.html.gz", "image.png.gz", "image.png.br"} {
+		if _, err := os.Stat(filepath.Join(out, name)); !os.IsNotExist(err) {
+			t.Errorf("Did not expect %s to be written", name)
+		}
+	}
+}
+
+func TestRenderTreeInPlace(t *testing.T) {
+	src := t.TempDir()
+	writeRenderFixture(t, src)
+
+	os.Setenv("RENDER_TITLE", "InPlace")
+	defer os.Unsetenv("RENDER_TITLE")
+
+	// Files that substitution leaves unchanged must not be touched
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{"plain.txt", "image.png"} {
+		if err := os.Chtimes(filepath.Join(src, name), old, old); err != nil {
+			t.Fatalf("Chtimes failed: %v", err)
+		}
+	}
+
+	envFS := EnvFileSystem{fs: http.Dir(src)}
+	if err := renderTree(envFS, src, "", false); err != nil {
+		t.Fatalf("renderTree failed: %v", err)
+	}
+
+	for _, name := range []string{"plain.txt", "image.png"} {
+		info, err := os.Stat(filepath.Join(src, name))
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if !info.ModTime().Equal(old) {
+			t.Errorf("Expected %s to keep its modification time, got %v", name, info.ModTime())
+		}
+	}
+	if got := readFile(t, filepath.Join(src, "index.html")); got != "<title>InPlace</title>" {
+		t.Errorf("Expected index.html to be rewritten, got %q", got)
+	}
+	if got := readFile(t, filepath.Join(src, "skip/config.js")); got != "InPlace" {
+		t.Errorf("Expected skip/config.js to be rewritten, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(src, "big.js.gz")); !os.IsNotExist(err) {
+		t.Error("Did not expect precompressed files when precompress is off")
+	}
+}
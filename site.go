@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// siteBuilder returns the handler serving the files in root with the given
+// fallback. key separates the site's entries in the shared content cache.
+type siteBuilder func(key, root, fallbackPath string) http.Handler
+
+// newSiteBuilder builds sites, such as vhosts, with the same pipeline as the
+// main site. envFS holds the substitution settings, or is nil if substitution
+// is disabled.
+func newSiteBuilder(envFS *EnvFileSystem) siteBuilder {
+	return func(key, root, fallbackPath string) http.Handler {
+		return siteHandler(siteFileSystem(key, root, fallbackPath, envFS), root)
+	}
+}
+
+// siteFileSystem layers the fallback and environment variable substitution
+// over the files in root.
+func siteFileSystem(key, root, fallbackPath string, envFS *EnvFileSystem) http.FileSystem {
+	var fileSystem http.FileSystem = http.Dir(root)
+	if fallbackPath != "" {
+		fileSystem = fallback{
+			defaultPath: fallbackPath,
+			fs:          fileSystem,
+		}
+	}
+	if envFS != nil {
+		siteEnvFS := *envFS
+		siteEnvFS.fs = fileSystem
+		siteEnvFS.cacheKey = key
+		siteEnvFS.filterPrefix, _ = relativeToBasePath(root)
+		fileSystem = siteEnvFS
+	}
+	return fileSystem
+}
+
+// relativeToBasePath returns the slash-separated path of root below the static
+// files path, or false if root is outside of it. The static files path itself
+// is "".
+func relativeToBasePath(root string) (string, bool) {
+	rel, err := filepath.Rel(*basePath, root)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if rel == "." {
+		return "", true
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// siteHandler serves fileSystem with precompressed siblings from root, ETags
+// and the request handling shared by all sites.
+func siteHandler(fileSystem http.FileSystem, root string) http.Handler {
+	hooks := []fileHook{setETag}
+	if !*disableCompression {
+		hooks = append(hooks, precompressedSibling(http.Dir(root)))
+	}
+	return handleReq(fileServer(fileSystem, hooks...))
+}
@@ -2,10 +2,17 @@ package main
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"net"
 	"net/http"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 func vhostFromHostname(host string) (string, error) {
@@ -16,20 +23,101 @@ func vhostFromHostname(host string) (string, error) {
 	return pieces[0], nil
 }
 
-func vhostify(base http.Handler, f http.FileSystem) http.Handler {
-	vhosts := detectVhosts(f)
+// vhostResolver maps request hosts to vhost directories. Hosts are matched by
+// their full name first, then by the wildcards, then by the domains. Without
+// domains the first label of hosts with three or more labels is used.
+type vhostResolver struct {
+	domains   []string
+	wildcards []vhostWildcard
+}
+
+// vhostWildcard maps hosts ending in suffix, such as .preview.example.com, to
+// the subdirectory of dir named after the remaining label.
+type vhostWildcard struct {
+	suffix string
+	dir    string
+}
+
+// newVhostResolver parses --vhost-domain, a comma-separated list of domains,
+// and --vhost-wildcard, a comma-separated list of *.domain or *.domain=dir
+// entries.
+func newVhostResolver(domains, wildcards string) (vhostResolver, error) {
+	var resolver vhostResolver
+	for _, domain := range parsePatterns(domains) {
+		resolver.domains = append(resolver.domains, normalizeHost(domain))
+	}
+	for _, entry := range parsePatterns(wildcards) {
+		pattern, dir, _ := strings.Cut(entry, "=")
+		suffix, ok := strings.CutPrefix(strings.TrimSpace(pattern), "*.")
+		if !ok || suffix == "" || strings.Contains(suffix, "*") {
+			return vhostResolver{}, fmt.Errorf("invalid vhost wildcard %q, expected *.domain or *.domain=dir", entry)
+		}
+		dir = strings.Trim(path.Clean("/"+strings.TrimSpace(dir)), "/")
+		resolver.wildcards = append(resolver.wildcards, vhostWildcard{suffix: "." + normalizeHost(suffix), dir: dir})
+	}
+	return resolver, nil
+}
+
+// normalizeHost strips the port and trailing dot from a host and lowercases it.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// resolve returns the name of the vhost serving host, checking candidates
+// against exists.
+func (v vhostResolver) resolve(host string, exists func(name string) bool) (string, bool) {
+	host = normalizeHost(host)
+	if host == "" {
+		return "", false
+	}
+	if exists(host) {
+		return host, true
+	}
+
+	for _, wildcard := range v.wildcards {
+		label, ok := strings.CutSuffix(host, wildcard.suffix)
+		if !ok || label == "" || strings.Contains(label, ".") {
+			continue
+		}
+		if name := path.Join(wildcard.dir, label); exists(name) {
+			return name, true
+		}
+	}
+
+	for _, domain := range v.domains {
+		if name, ok := strings.CutSuffix(host, "."+domain); ok && exists(name) {
+			return name, true
+		}
+	}
+	if len(v.domains) > 0 {
+		return "", false
+	}
+
+	name, err := vhostFromHostname(host)
+	if err != nil || !exists(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// vhostify serves requests for the hosts in sites from their configured
+// vhost, and all other hosts from the discovered vhost directories.
+func vhostify(base http.Handler, vhosts *vhostTable, sites vhostSites) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		vhost, err := vhostFromHostname(r.Host)
-		if err != nil {
-			base.ServeHTTP(w, r)
+		if handler, ok := sites.lookup(r.Host); ok {
+			handler.ServeHTTP(w, r)
 			return
 		}
-		host, exists := vhosts[vhost]
-		if exists {
-			host.handler.ServeHTTP(w, r)
+		vhost, ok := vhosts.resolve(r.Host)
+		if !ok {
+			base.ServeHTTP(w, r)
 			return
 		}
-		base.ServeHTTP(w, r)
+		log.Debug().Str("host", r.Host).Str("vhost", vhost.prefix).Msg("Serving vhost")
+		vhost.handler.ServeHTTP(w, r)
 	})
 }
 
@@ -38,19 +126,131 @@ type VHost struct {
 	handler http.Handler
 }
 
-func detectVhosts(fileSystem http.FileSystem) map[string]VHost {
-	vhostRoot, err := fileSystem.Open(*vhostPrefix)
+// vhostTable holds the discovered vhosts. Every scan replaces the whole table,
+// so requests never see a partial one.
+type vhostTable struct {
+	fs       http.FileSystem
+	root     string
+	fallback string
+	resolver vhostResolver
+	newSite  siteBuilder
+	vhosts   atomic.Pointer[map[string]VHost]
+}
+
+// newVhostTable scans the vhost root once. It fails if the root can't be read.
+// Every vhost is built by newSite, with the --fallback of the main site.
+func newVhostTable(fileSystem http.FileSystem, resolver vhostResolver, newSite siteBuilder) (*vhostTable, error) {
+	table := &vhostTable{
+		fs:       fileSystem,
+		root:     filepath.Join(*basePath, *vhostPrefix),
+		fallback: *fallbackPath,
+		resolver: resolver,
+		newSite:  newSite,
+	}
+	if err := table.rescan(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func (t *vhostTable) resolve(host string) (VHost, bool) {
+	vhosts := *t.vhosts.Load()
+	name, ok := t.resolver.resolve(host, func(name string) bool {
+		_, ok := vhosts[name]
+		return ok
+	})
+	if !ok {
+		return VHost{}, false
+	}
+	return vhosts[name], true
+}
+
+// dir is the directory on disk of the vhost name.
+func (t *vhostTable) dir(name string) string {
+	return filepath.Join(t.root, filepath.FromSlash(name))
+}
+
+// rescan lists the vhost directories again and swaps in the new table. Vhosts
+// that still exist keep their handler.
+func (t *vhostTable) rescan() error {
+	names, err := detectVhosts(t.fs, t.resolver)
 	if err != nil {
-		log.Fatalf("Error opening vhost root: %v", err)
+		return err
+	}
+
+	previous := t.vhosts.Load()
+	vhosts := make(map[string]VHost, len(names))
+	var added, removed []string
+	for _, name := range names {
+		if previous != nil {
+			if vhost, ok := (*previous)[name]; ok {
+				vhosts[name] = vhost
+				continue
+			}
+		}
+		vhosts[name] = VHost{name, t.newSite("vhost:"+name, t.dir(name), t.fallback)}
+		added = append(added, name)
+	}
+	if previous != nil {
+		for name := range *previous {
+			if _, ok := vhosts[name]; !ok {
+				removed = append(removed, name)
+			}
+		}
+		sort.Strings(removed)
+	}
+	t.vhosts.Store(&vhosts)
+
+	if len(added) > 0 || len(removed) > 0 {
+		log.Debug().Int("vhosts", len(vhosts)).Strs("added", added).Strs("removed", removed).Msg("Vhosts updated")
+	}
+	return nil
+}
+
+// watch rescans the vhosts whenever a directory is added to or removed from
+// the vhost root or a wildcard directory. If a scan fails the previous vhosts
+// stay active.
+func (t *vhostTable) watch(interval time.Duration) (stop func()) {
+	paths := []string{t.root}
+	for _, wildcard := range t.resolver.wildcards {
+		paths = append(paths, filepath.Join(t.root, filepath.FromSlash(wildcard.dir)))
 	}
-	vhostDirs, err := vhostRoot.Readdir(512)
-	vhosts := make(map[string]VHost)
-	vhostBase := path.Join(*basePath, *vhostPrefix)
-	for _, dir := range vhostDirs {
-		if dir.IsDir() {
-			name := dir.Name()
-			vhosts[name] = VHost{name, http.FileServer(http.Dir(path.Join(vhostBase, name)))}
+	log.Debug().Strs("paths", paths).Dur("interval", interval).Msg("Watching vhost directories")
+	return watchPaths(paths, interval, func() {
+		if err := t.rescan(); err != nil {
+			log.Error().Err(err).Msg("Failed to rescan vhosts, keeping previous vhosts")
+		}
+	})
+}
+
+// detectVhosts lists the directories in the vhost root, plus the directories
+// inside each wildcard directory, as sorted paths relative to the root.
+func detectVhosts(fileSystem http.FileSystem, resolver vhostResolver) ([]string, error) {
+	var names []string
+	dirs := []string{""}
+	for _, wildcard := range resolver.wildcards {
+		dirs = append(dirs, wildcard.dir)
+	}
+	for i, dir := range dirs {
+		vhostRoot, err := fileSystem.Open(path.Join("/", *vhostPrefix, dir))
+		if err != nil {
+			if i == 0 {
+				return nil, fmt.Errorf("error opening vhost root: %w", err)
+			}
+			log.Debug().Str("dir", dir).Err(err).Msg("Skipping missing vhost wildcard directory")
+			continue
+		}
+		vhostDirs, err := vhostRoot.Readdir(-1)
+		vhostRoot.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading vhost directory %s: %w", path.Join("/", *vhostPrefix, dir), err)
+		}
+		for _, entry := range vhostDirs {
+			if entry.IsDir() {
+				names = append(names, path.Join(dir, entry.Name()))
+			}
 		}
 	}
-	return vhosts
+	sort.Strings(names)
+	return names, nil
 }
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestVhostParsing(t *testing.T) {
@@ -27,3 +35,244 @@ func TestVhostParsing(t *testing.T) {
 		t.Errorf("Expected %s when serving %s, got %s and %v", "hello", "hello.world.fff.red", vhost, err)
 	}
 }
+
+func TestVhostResolver(t *testing.T) {
+	vhosts := map[string]bool{
+		"example.com":             true,
+		"shop.example.org":        true,
+		"app.staging":             true,
+		"wtf":                     true,
+		"previews/feature-x":      true,
+		"feature-x":               true,
+		"app.staging.example.com": false,
+	}
+	exists := func(name string) bool { return vhosts[name] }
+
+	legacy, err := newVhostResolver("", "")
+	if err != nil {
+		t.Fatalf("newVhostResolver failed: %v", err)
+	}
+	resolver, err := newVhostResolver("example.com, example.net", "*.preview.example.com=previews,*.pr.example.com")
+	if err != nil {
+		t.Fatalf("newVhostResolver failed: %v", err)
+	}
+
+	tests := []struct {
+		resolver vhostResolver
+		host     string
+		expected string
+		desc     string
+	}{
+		{legacy, "wtf.fff.red", "wtf", "first label without domains"},
+		{legacy, "fff.red", "", "two labels without domains"},
+		{legacy, "Example.COM:8080", "example.com", "full hostname with port and case"},
+		{legacy, "example.com.", "example.com", "full hostname with trailing dot"},
+		{resolver, "shop.example.org", "shop.example.org", "full hostname for apex of other domain"},
+		{resolver, "app.staging.example.com", "app.staging", "multi-level subdomain of domain"},
+		{resolver, "app.staging.example.net", "app.staging", "subdomain of second domain"},
+		{resolver, "wtf.example.com", "wtf", "single label subdomain of domain"},
+		{resolver, "wtf.fff.red", "", "no first label fallback with domains"},
+		{resolver, "missing.example.com", "", "unknown subdomain of domain"},
+		{resolver, "feature-x.preview.example.com", "previews/feature-x", "wildcard with directory"},
+		{resolver, "feature-x.pr.example.com", "feature-x", "wildcard without directory"},
+		{resolver, "a.feature-x.preview.example.com", "", "wildcard matches a single label only"},
+		{resolver, "preview.example.com", "", "wildcard does not match its own domain"},
+	}
+
+	for _, test := range tests {
+		vhost, ok := test.resolver.resolve(test.host, exists)
+		if vhost != test.expected || ok != (test.expected != "") {
+			t.Errorf("%s: resolve(%q) = %q, %v, want %q", test.desc, test.host, vhost, ok, test.expected)
+		}
+	}
+}
+
+func TestNewVhostResolverInvalid(t *testing.T) {
+	for _, wildcard := range []string{"preview.example.com=previews", "*.=previews", "*.*.example.com"} {
+		if _, err := newVhostResolver("", wildcard); err == nil {
+			t.Errorf("Expected error for wildcard %q", wildcard)
+		}
+	}
+}
+
+func TestVhostify(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"example.com/index.txt":          "apex",
+		"app.staging/index.txt":          "staging",
+		"previews/feature-x/index.txt":   "feature",
+		"previews/feature-y/ignored.txt": "",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	oldBasePath := *basePath
+	*basePath = dir
+	defer func() { *basePath = oldBasePath }()
+
+	resolver, err := newVhostResolver("example.com", "*.preview.example.com=previews")
+	if err != nil {
+		t.Fatalf("newVhostResolver failed: %v", err)
+	}
+	base := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "base")
+	})
+	vhosts, err := newVhostTable(http.Dir(dir), resolver, newSiteBuilder(nil))
+	if err != nil {
+		t.Fatalf("newVhostTable failed: %v", err)
+	}
+	handler := vhostify(base, vhosts, vhostSites{})
+
+	tests := map[string]string{
+		"example.com":                   "apex",
+		"app.staging.example.com":       "staging",
+		"feature-x.preview.example.com": "feature",
+		"other.example.org":             "base",
+	}
+	for host, expected := range tests {
+		req := httptest.NewRequest("GET", "/index.txt", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Body.String() != expected {
+			t.Errorf("Expected %q for host %s, got %q", expected, host, rec.Body.String())
+		}
+	}
+}
+
+func TestVhostTableRescan(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 600; i++ {
+		if err := os.Mkdir(filepath.Join(dir, fmt.Sprintf("site%03d", i)), 0755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+
+	oldBasePath := *basePath
+	*basePath = dir
+	defer func() { *basePath = oldBasePath }()
+
+	var built atomic.Int32
+	newSite := func(key, root, fallbackPath string) http.Handler {
+		built.Add(1)
+		return newSiteBuilder(nil)(key, root, fallbackPath)
+	}
+	resolver, _ := newVhostResolver("example.com", "")
+	vhosts, err := newVhostTable(http.Dir(dir), resolver, newSite)
+	if err != nil {
+		t.Fatalf("newVhostTable failed: %v", err)
+	}
+	if _, ok := vhosts.resolve("site599.example.com"); !ok {
+		t.Error("Expected all vhost directories to be detected")
+	}
+
+	stop := vhosts.watch(10 * time.Millisecond)
+	defer stop()
+	if err := os.Mkdir(filepath.Join(dir, "new"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "site001")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, added := vhosts.resolve("new.example.com")
+		_, kept := vhosts.resolve("site001.example.com")
+		if added && !kept {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected vhosts to be rescanned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := built.Load(); n != 601 {
+		t.Errorf("Expected unchanged vhosts to keep their handler, built %d", n)
+	}
+}
+
+func TestVhostPipeline(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"one/index.html":      "<p>one ${VHOST_PIPELINE}</p>",
+		"two/index.html":      "<p>two ${VHOST_PIPELINE}</p>",
+		"one/vendor/lib/x.js": "${VHOST_PIPELINE}",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	os.Setenv("VHOST_PIPELINE", "substituted")
+	defer os.Unsetenv("VHOST_PIPELINE")
+
+	oldBasePath, oldFallbackPath := *basePath, *fallbackPath
+	*basePath, *fallbackPath = dir, "/index.html"
+	defer func() { *basePath, *fallbackPath = oldBasePath, oldFallbackPath }()
+
+	envFS := &EnvFileSystem{cache: newContentCache(1 << 20), filter: newEnvFilter("", "one/vendor/lib")}
+	resolver, _ := newVhostResolver("example.com", "")
+	vhosts, err := newVhostTable(http.Dir(dir), resolver, newSiteBuilder(envFS))
+	if err != nil {
+		t.Fatalf("newVhostTable failed: %v", err)
+	}
+	handler := vhostify(http.NotFoundHandler(), vhosts, vhostSites{})
+
+	for _, name := range []string{"one", "two", "one"} {
+		req := httptest.NewRequest("GET", "/deep/link", nil)
+		req.Host = name + ".example.com"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		expected := "<p>" + name + " substituted</p>"
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Errorf("Expected %q for %s, got %d %q", expected, req.Host, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("ETag") == "" {
+			t.Errorf("Expected an ETag for %s", req.Host)
+		}
+	}
+
+	// Include/exclude rules match paths relative to the static files path
+	req := httptest.NewRequest("GET", "/vendor/lib/x.js", nil)
+	req.Host = "one.example.com"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Body.String() != "${VHOST_PIPELINE}" {
+		t.Errorf("Expected excluded file to be served untouched, got %q", rec.Body.String())
+	}
+}
+
+func TestRelativeToBasePath(t *testing.T) {
+	oldBasePath := *basePath
+	*basePath = filepath.FromSlash("/srv/http")
+	defer func() { *basePath = oldBasePath }()
+
+	tests := []struct {
+		root   string
+		rel    string
+		inside bool
+	}{
+		{"/srv/http", "", true},
+		{"/srv/http/sites/one", "sites/one", true},
+		{"/srv/http/..data", "..data", true},
+		{"/srv/other", "", false},
+		{"/srv", "", false},
+	}
+	for _, test := range tests {
+		rel, inside := relativeToBasePath(filepath.FromSlash(test.root))
+		if rel != test.rel || inside != test.inside {
+			t.Errorf("relativeToBasePath(%s) = %q, %v, want %q, %v", test.root, rel, inside, test.rel, test.inside)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VhostConfigArray is the content of the --vhost-config file.
+type VhostConfigArray struct {
+	Vhosts []VhostConfig `json:"vhosts" yaml:"vhosts" toml:"vhosts"`
+}
+
+// VhostConfig serves Hosts from Root. Hosts are exact names such as
+// example.com or wildcards such as *.example.com, which match subdomains at any
+// depth. A relative Root is resolved against the static files path. Fallback
+// and Context work like --fallback and --context, Headers are applied to every
+// response and Auth, given as user:password, enables basic auth.
+type VhostConfig struct {
+	Hosts    []string          `json:"hosts" yaml:"hosts" toml:"hosts"`
+	Root     string            `json:"root" yaml:"root" toml:"root"`
+	Fallback string            `json:"fallback,omitempty" yaml:"fallback" toml:"fallback"`
+	Context  string            `json:"context,omitempty" yaml:"context" toml:"context"`
+	Headers  []HeaderDefiniton `json:"headers,omitempty" yaml:"headers" toml:"headers"`
+	Auth     string            `json:"auth,omitempty" yaml:"auth" toml:"auth"`
+}
+
+// loadVhostConfig strictly decodes and validates a JSON, YAML or TOML vhost
+// config file. A host may only be mapped once.
+func loadVhostConfig(vhostConfigPath string) (VhostConfigArray, error) {
+	var configs VhostConfigArray
+	if err := decodeConfigFile(vhostConfigPath, &configs); err != nil {
+		return VhostConfigArray{}, err
+	}
+	seen := make(map[string]int)
+	for i, config := range configs.Vhosts {
+		if err := config.validate(); err != nil {
+			return VhostConfigArray{}, fmt.Errorf("%s: vhost %d: %w", vhostConfigPath, i, err)
+		}
+		for _, host := range config.Hosts {
+			host = normalizeHost(host)
+			if j, ok := seen[host]; ok {
+				return VhostConfigArray{}, fmt.Errorf("%s: vhost %d: host %s is already mapped by vhost %d", vhostConfigPath, i, host, j)
+			}
+			seen[host] = i
+		}
+	}
+	return configs, nil
+}
+
+// definitions lists the headers of all vhosts.
+func (c VhostConfigArray) definitions() []HeaderDefiniton {
+	var headers []HeaderDefiniton
+	for _, config := range c.Vhosts {
+		headers = append(headers, config.Headers...)
+	}
+	return headers
+}
+
+func (c VhostConfig) validate() error {
+	if len(c.Hosts) == 0 {
+		return errors.New("no hosts")
+	}
+	for _, host := range c.Hosts {
+		name := strings.TrimPrefix(normalizeHost(host), "*.")
+		if name == "" || strings.ContainsAny(name, "*/ ") {
+			return fmt.Errorf("invalid host %q", host)
+		}
+	}
+	if strings.TrimSpace(c.Root) == "" {
+		return errors.New("no root")
+	}
+	if c.Auth != "" && len(strings.Split(c.Auth, ":")) != 2 {
+		return errors.New("auth must be like this: user:password")
+	}
+	return validateHeaderDefinitions(c.Headers)
+}
+
+func (c VhostConfig) rootPath() string {
+	if filepath.IsAbs(c.Root) {
+		return filepath.Clean(c.Root)
+	}
+	return filepath.Join(*basePath, c.Root)
+}
+
+// handler serves the vhost root through newSite, with the vhost's fallback,
+// or --fallback if it has none, and its context, headers and auth.
+func (c VhostConfig) handler(newSite siteBuilder) http.Handler {
+	defaultPath := c.Fallback
+	if defaultPath == "" {
+		defaultPath = *fallbackPath
+	}
+
+	handler := newSite("vhost-config:"+normalizeHost(c.Hosts[0]), c.rootPath(), defaultPath)
+	if context := strings.Trim(c.Context, "/"); context != "" {
+		handler = http.StripPrefix("/"+context+"/", handler)
+	}
+	if len(c.Headers) > 0 {
+		headers := c.Headers
+		handler = beforeWriteHeader(handler, func(w http.ResponseWriter, r *http.Request, status int) {
+			applyHeaderDefinitions(w.Header(), headers)
+		})
+	}
+	if c.Auth != "" {
+		user, pass, _ := strings.Cut(c.Auth, ":")
+		handler = basicAuthHandler(handler, user, pass)
+	}
+	return handler
+}
+
+// vhostSites routes hosts to the vhosts of the vhost config. Exact hosts are
+// checked first, then wildcards from the longest suffix to the shortest.
+type vhostSites struct {
+	exact     map[string]http.Handler
+	wildcards []vhostSiteWildcard
+	roots     []string
+}
+
+type vhostSiteWildcard struct {
+	suffix  string
+	handler http.Handler
+}
+
+// newVhostSites builds the handlers of the configured vhosts with newSite.
+// Every root must be an existing directory.
+func newVhostSites(configs VhostConfigArray, newSite siteBuilder) (vhostSites, error) {
+	sites := vhostSites{exact: make(map[string]http.Handler)}
+	for _, config := range configs.Vhosts {
+		if info, err := os.Stat(config.rootPath()); err != nil || !info.IsDir() {
+			return vhostSites{}, fmt.Errorf("vhost root %s for %s is not a directory", config.rootPath(), strings.Join(config.Hosts, ", "))
+		}
+		handler := config.handler(newSite)
+		sites.roots = append(sites.roots, config.rootPath())
+		for _, host := range config.Hosts {
+			host = normalizeHost(host)
+			if suffix, ok := strings.CutPrefix(host, "*"); ok {
+				sites.wildcards = append(sites.wildcards, vhostSiteWildcard{suffix: suffix, handler: handler})
+			} else {
+				sites.exact[host] = handler
+			}
+		}
+	}
+	sort.SliceStable(sites.wildcards, func(i, j int) bool {
+		return len(sites.wildcards[i].suffix) > len(sites.wildcards[j].suffix)
+	})
+	return sites, nil
+}
+
+func (s vhostSites) lookup(host string) (http.Handler, bool) {
+	host = normalizeHost(host)
+	if handler, ok := s.exact[host]; ok {
+		return handler, true
+	}
+	for _, wildcard := range s.wildcards {
+		if strings.HasSuffix(host, wildcard.suffix) {
+			return wildcard.handler, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadVhostConfig(t *testing.T) {
+	path := writeConfigFile(t, "vhosts.yaml", `
+vhosts:
+  - hosts: [example.com, www.example.com]
+    root: /srv/sites/example
+    fallback: /index.html
+  - hosts: ["*.preview.example.com"]
+    root: previews
+    auth: preview:secret
+    headers:
+      - key: X-Robots-Tag
+        value: noindex
+`)
+	configs, err := loadVhostConfig(path)
+	if err != nil {
+		t.Fatalf("loadVhostConfig failed: %v", err)
+	}
+	if len(configs.Vhosts) != 2 || len(configs.Vhosts[0].Hosts) != 2 || configs.Vhosts[1].Auth != "preview:secret" {
+		t.Errorf("Unexpected vhost config: %+v", configs)
+	}
+
+	invalid := map[string]string{
+		"no hosts":       `{"vhosts": [{"root": "site"}]}`,
+		"no root":        `{"vhosts": [{"hosts": ["example.com"]}]}`,
+		"invalid host":   `{"vhosts": [{"hosts": ["*.*.example.com"], "root": "site"}]}`,
+		"invalid auth":   `{"vhosts": [{"hosts": ["example.com"], "root": "site", "auth": "user"}]}`,
+		"invalid header": `{"vhosts": [{"hosts": ["example.com"], "root": "site", "headers": [{"value": "x"}]}]}`,
+		"duplicate host": `{"vhosts": [{"hosts": ["example.com"], "root": "a"}, {"hosts": ["Example.com"], "root": "b"}]}`,
+		"unknown field":  `{"vhosts": [{"hosts": ["example.com"], "root": "site", "index": "x"}]}`,
+	}
+	for desc, content := range invalid {
+		if _, err := loadVhostConfig(writeConfigFile(t, "vhosts.json", content)); err == nil {
+			t.Errorf("%s: expected an error", desc)
+		}
+	}
+}
+
+func TestVhostSites(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"site/index.html":      "site",
+		"site/docs/page.html":  "page",
+		"preview/index.html":   "preview",
+		"previews/index.html":  "previews",
+		"previews/robots.txt":  "robots",
+		"secret/index.html":    "secret",
+		"elsewhere/index.html": "elsewhere",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	oldBasePath := *basePath
+	*basePath = dir
+	defer func() { *basePath = oldBasePath }()
+
+	configs := VhostConfigArray{Vhosts: []VhostConfig{
+		{Hosts: []string{"example.com", "www.example.com"}, Root: "site", Fallback: "/index.html", Context: "app"},
+		{Hosts: []string{"*.example.com"}, Root: "previews", Headers: []HeaderDefiniton{{Key: "X-Robots-Tag", Value: "noindex"}}},
+		{Hosts: []string{"*.preview.example.com"}, Root: "preview"},
+		{Hosts: []string{"secret.example.org"}, Root: "secret", Auth: "user:pass"},
+		{Hosts: []string{"other.example.org"}, Root: filepath.Join(dir, "elsewhere")},
+	}}
+	sites, err := newVhostSites(configs, newSiteBuilder(nil))
+	if err != nil {
+		t.Fatalf("newVhostSites failed: %v", err)
+	}
+
+	tests := []struct {
+		host     string
+		path     string
+		status   int
+		expected string
+	}{
+		{"example.com", "/app/docs/page.html", http.StatusOK, "page"},
+		{"WWW.example.com:8080", "/app/missing/route", http.StatusOK, "site"},
+		{"example.com", "/docs/page.html", http.StatusNotFound, ""},
+		{"a.b.example.com", "/robots.txt", http.StatusOK, "robots"},
+		{"feature.preview.example.com", "/", http.StatusOK, "preview"},
+		{"secret.example.org", "/", http.StatusUnauthorized, ""},
+		{"other.example.org", "/", http.StatusOK, "elsewhere"},
+	}
+	for _, test := range tests {
+		handler, ok := sites.lookup(test.host)
+		if !ok {
+			t.Errorf("Expected a vhost for %s", test.host)
+			continue
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status || (test.expected != "" && rec.Body.String() != test.expected) {
+			t.Errorf("%s%s: expected %d %q, got %d %q", test.host, test.path, test.status, test.expected, rec.Code, rec.Body.String())
+		}
+	}
+
+	if _, ok := sites.lookup("example.org"); ok {
+		t.Error("Expected no vhost for example.org")
+	}
+
+	handler, _ := sites.lookup("a.example.com")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Header().Get("X-Robots-Tag") != "noindex" {
+		t.Errorf("Expected vhost header, got %v", rec.Header())
+	}
+
+	handler, _ = sites.lookup("secret.example.org")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("user", "pass")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("Expected authorized request to succeed, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	configs.Vhosts = append(configs.Vhosts, VhostConfig{Hosts: []string{"missing.example.org"}, Root: "missing"})
+	if _, err := newVhostSites(configs, newSiteBuilder(nil)); err == nil {
+		t.Error("Expected an error for a missing root")
+	}
+}
+
+func TestCheckEnvVarsInVhostHeaders(t *testing.T) {
+	os.Setenv("VHOSTHDR_SET", "set")
+	defer os.Unsetenv("VHOSTHDR_SET")
+
+	configs := VhostConfigArray{Vhosts: []VhostConfig{
+		{Hosts: []string{"a.example.com"}, Root: "a", Headers: []HeaderDefiniton{{Key: "X-Set", Value: "${VHOSTHDR_SET}"}}},
+		{Hosts: []string{"b.example.com"}, Root: "b", Headers: []HeaderDefiniton{{Key: "X-Missing", Value: "${VHOSTHDR_MISSING}"}}},
+	}}
+
+	err := checkEnvVarsInHeaders("vhost config", configs.definitions())
+	want := "missing environment variables in vhost config: VHOSTHDR_MISSING"
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchPaths polls paths every interval and calls onChange whenever their
+// fingerprint differs from the previous poll. Polling works the same on every
+// platform and follows the symlink swaps used by Kubernetes volume mounts.
+// The returned function stops the watcher.
+func watchPaths(paths []string, interval time.Duration, onChange func()) (stop func()) {
+	done := make(chan struct{})
+	last := fingerprintPaths(paths)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				current := fingerprintPaths(paths)
+				if current != last {
+					last = current
+					onChange()
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// fingerprintPaths summarizes the size and modification time of each path and,
+// for directories, of each entry inside it.
+func fingerprintPaths(paths []string) string {
+	var b strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(&b, "%s:missing;", path)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		if !info.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			entryPath := filepath.Join(path, entry.Name())
+			if entryInfo, err := os.Stat(entryPath); err == nil {
+				fmt.Fprintf(&b, "%s:%d:%d;", entryPath, entryInfo.Size(), entryInfo.ModTime().UnixNano())
+			}
+		}
+	}
+	return b.String()
+}